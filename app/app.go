@@ -13,9 +13,12 @@ import (
 
 	"github.com/hiwyw/dnscap-tool/app/config"
 	"github.com/hiwyw/dnscap-tool/app/handler"
+	"github.com/hiwyw/dnscap-tool/app/handler/cachestat"
+	"github.com/hiwyw/dnscap-tool/app/handler/correlation"
 	"github.com/hiwyw/dnscap-tool/app/handler/dnsdb"
 	"github.com/hiwyw/dnscap-tool/app/handler/dnslog"
 	"github.com/hiwyw/dnscap-tool/app/handler/ipinfo"
+	"github.com/hiwyw/dnscap-tool/app/handler/quarantine"
 	"github.com/hiwyw/dnscap-tool/app/handler/session"
 	td "github.com/hiwyw/dnscap-tool/app/handler/trafficdirection"
 	"github.com/hiwyw/dnscap-tool/app/handler/tunnelsec"
@@ -27,6 +30,9 @@ const (
 	snapshot_len = 1500
 
 	promiscuous = true
+
+	// 会话分片worker的队列长度
+	dispatchQueueSize = 1024
 )
 
 func NewApp(cfg *config.Config) *App {
@@ -39,12 +45,6 @@ func NewApp(cfg *config.Config) *App {
 		closeOnce:          sync.Once{},
 	}
 
-	pool, err := ants.NewPool(a.cfg.HandlerWorkerCount)
-	if err != nil {
-		logger.Fatal(err)
-	}
-	a.pool = pool
-
 	if cfg.PprofEnable {
 		go pprof(cfg.PprofHttpPort)
 	}
@@ -56,28 +56,115 @@ func NewApp(cfg *config.Config) *App {
 		a.wg.Done()
 	}
 
+	decodeOpts := types.DecodeOptions{
+		DnsPorts:  a.cfg.DnsPorts,
+		Heuristic: a.cfg.DnsHeuristic,
+		KeepRaw:   a.cfg.KeepRaw,
+	}
+
 	switch a.cfg.InputType {
 	case config.InputTypePcap:
-		a.source = types.NewCaptureSource(childCtx, a.cfg.DecodeWorkerCount, a.cfg.Device, a.cfg.BpfFilter, finalizer)
+		devices := []types.CaptureDevice{}
+		for _, d := range a.cfg.GetDevices() {
+			devices = append(devices, types.CaptureDevice{Name: d.Name, BpfFilter: d.BpfFilter})
+		}
+		a.source = types.NewCaptureSource(childCtx, a.cfg.DecodeWorkerCount, devices, decodeOpts, types.CaptureOptions{
+			Mode:          types.CaptureMode(a.cfg.CaptureMode),
+			SnapLen:       a.cfg.SnapLen,
+			RingSizeMB:    a.cfg.AfpacketConfig.RingSizeMB,
+			BlockSizeKB:   a.cfg.AfpacketConfig.BlockSizeKB,
+			FanoutGroup:   a.cfg.AfpacketConfig.FanoutGroup,
+			FanoutType:    a.cfg.AfpacketConfig.FanoutType,
+			FanoutReaders: a.cfg.AfpacketConfig.FanoutReaders,
+		}, finalizer)
 		a.wg.Add(1)
 	case config.InputTypePcapFile:
-		a.source = types.NewFilesSource(childCtx, a.cfg.DecodeWorkerCount, a.cfg.PcapFiles, a.cfg.BpfFilter, finalizer)
+		replaySpeed, err := types.ParseReplaySpeed(a.cfg.ReplaySpeed)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		startTime, err := parseOptionalTime(a.cfg.StartTime)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		endTime, err := parseOptionalTime(a.cfg.EndTime)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		a.source = types.NewFilesSource(childCtx, a.cfg.DecodeWorkerCount, a.cfg.PcapFiles, a.cfg.GetBpfFilter(), decodeOpts, types.FileOptions{
+			ReplaySpeed: replaySpeed,
+			StartTime:   startTime,
+			EndTime:     endTime,
+			SkipPackets: a.cfg.SkipPackets,
+			MaxPackets:  a.cfg.MaxPackets,
+		}, finalizer)
+		a.wg.Add(1)
+	case config.InputTypeWatch:
+		pollInterval, err := time.ParseDuration(a.cfg.WatchConfig.PollInterval)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		settleTime, err := time.ParseDuration(a.cfg.WatchConfig.SettleTime)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		a.source = types.NewWatchSource(childCtx, a.cfg.DecodeWorkerCount, a.cfg.GetBpfFilter(), decodeOpts, types.WatchOptions{
+			Dir:          a.cfg.WatchConfig.Dir,
+			Pattern:      a.cfg.WatchConfig.Pattern,
+			PollInterval: pollInterval,
+			SettleTime:   settleTime,
+			LedgerFile:   a.cfg.WatchConfig.LedgerFile,
+			Action:       types.WatchAction(a.cfg.WatchConfig.AfterProcess),
+			MoveDir:      a.cfg.WatchConfig.MoveDir,
+		}, finalizer)
+		a.wg.Add(1)
+	case config.InputTypeDnstap:
+		a.source = types.NewDnstapSource(childCtx, a.cfg.DecodeWorkerCount, types.DnstapSocketType(a.cfg.DnstapConfig.SocketType), a.cfg.DnstapConfig.Address, a.cfg.KeepRaw, finalizer)
 		a.wg.Add(1)
+	default:
+		logger.Fatalf("unknown input type %s", a.cfg.InputType)
 	}
 
+	trafficDirectionLoaded := false
+	correlationLoaded := false
 	for _, h := range a.cfg.MiddlewareHandlers {
 		switch h {
 		case config.SessionType:
 			if a.cfg.SessionConfig.Enable {
-				a.middlewareHandlers = append(
-					a.middlewareHandlers,
-					session.NewHandler(
-						childCtx,
-						a.cfg.SessionConfig.SessionCacheSize))
-				logger.Warnf("when session handler enabled, dns events cannot be processed in parallel， so will reset worker count to 1")
-				a.source.SetWorkerCount(1)
-				a.pool.Tune(1)
-
+				var queryTimeout time.Duration
+				if a.cfg.SessionConfig.QueryTimeout != "" {
+					d, err := time.ParseDuration(a.cfg.SessionConfig.QueryTimeout)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					queryTimeout = d
+				}
+				var retryWindow time.Duration
+				if a.cfg.SessionConfig.RetryWindow != "" {
+					d, err := time.ParseDuration(a.cfg.SessionConfig.RetryWindow)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					retryWindow = d
+				}
+				// 会话插件生成的事件从其后的中间件继续处理
+				next := len(a.middlewareHandlers) + 1
+				a.session = session.NewHandler(
+					childCtx,
+					a.cfg.SessionConfig.SessionCacheSize,
+					a.cfg.HandlerWorkerCount,
+					a.cfg.DnsPorts,
+					queryTimeout,
+					retryWindow,
+					a.cfg.SessionConfig.TransactionMode,
+					func(e *types.DnsEvent) {
+						a.handleFrom(next, e)
+					})
+				a.middlewareHandlers = append(a.middlewareHandlers, a.session)
+				// 同一会话流的事件由固定worker顺序处理，保证请求先于响应进入会话表
+				a.dispatcher = session.NewDispatcher(a.cfg.HandlerWorkerCount, dispatchQueueSize, func(e *types.DnsEvent) {
+					a.handleFrom(0, e)
+				})
 			}
 		case config.IpInfoType:
 			if a.cfg.IpInfoConfig.Enable {
@@ -104,7 +191,60 @@ func NewApp(cfg *config.Config) *App {
 					a.middlewareHandlers,
 					td.NewHandler(
 						childCtx,
-						a.cfg.TrafficDirectionConfig.SelfIps))
+						a.cfg.TrafficDirectionConfig.SelfIps,
+						a.cfg.DnsPorts))
+				trafficDirectionLoaded = true
+			}
+		case config.CorrelationType:
+			if a.cfg.CorrelationConfig.Enable {
+				// 关联依赖流量方向，且需在请求输出时分配解析ID
+				if !trafficDirectionLoaded {
+					logger.Fatalf("correlation handler should be placed after an enabled traffic_direction handler")
+				}
+				if a.cfg.SessionConfig.Enable && a.cfg.SessionConfig.TransactionMode {
+					logger.Fatalf("correlation handler cannot work with session transaction_mode")
+				}
+				window, err := time.ParseDuration(a.cfg.CorrelationConfig.Window)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				var reorderWindow time.Duration
+				if a.cfg.CorrelationConfig.ReorderWindow != "" {
+					d, err := time.ParseDuration(a.cfg.CorrelationConfig.ReorderWindow)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					reorderWindow = d
+				}
+				// 按事件时间重排后输出的事件从其后的中间件继续处理
+				next := len(a.middlewareHandlers) + 1
+				a.correlation = correlation.NewHandler(
+					childCtx,
+					window,
+					reorderWindow,
+					a.cfg.CorrelationConfig.CacheSize,
+					func(e *types.DnsEvent) {
+						a.handleFrom(next, e)
+					})
+				a.middlewareHandlers = append(a.middlewareHandlers, a.correlation)
+				correlationLoaded = true
+			}
+		case config.CacheStatType:
+			if a.cfg.CacheStatConfig.Enable {
+				// 命中判断基于递归解析关联结果
+				if !correlationLoaded {
+					logger.Fatalf("cache_stat handler should be placed after an enabled correlation handler")
+				}
+				window, err := time.ParseDuration(a.cfg.CacheStatConfig.Window)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				a.cacheStat = cachestat.NewHandler(
+					childCtx,
+					window,
+					a.cfg.CacheStatConfig.TopDomainCount,
+					a.cfg.CacheStatConfig.MaxDomainCount)
+				a.middlewareHandlers = append(a.middlewareHandlers, a.cacheStat)
 			}
 		}
 	}
@@ -145,21 +285,53 @@ func NewApp(cfg *config.Config) *App {
 		}
 	}
 
+	if a.cfg.QuarantineConfig.Enable {
+		a.quarantine = quarantine.NewHandler(childCtx, a.cfg.QuarantineConfig.Filename, finalizer)
+		a.wg.Add(1)
+	}
+
 	if len(a.resultHandlers) < 1 {
 		logger.Fatalf("should at least one result handler")
 	}
 
+	// 启用会话插件时由Dispatcher按会话流分发，否则使用worker池并行处理
+	if a.dispatcher == nil {
+		pool, err := ants.NewPool(a.cfg.HandlerWorkerCount)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		a.pool = pool
+	}
+
 	statusTickerDuration, err := time.ParseDuration(a.cfg.StatusReportInterval)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	reporter := newReporter(childCtx, statusTickerDuration, finalizer)
+	reporter := newReporter(childCtx, statusTickerDuration, a.source.Stats, finalizer)
+	if a.session != nil {
+		reporter.sessionStats = a.session.Stats
+	}
+	if a.cacheStat != nil {
+		reporter.cacheStats = a.cacheStat.Stats
+	}
 	a.reporter = reporter
 	a.wg.Add(1)
 
 	return a
 }
 
+// parseOptionalTime 解析RFC3339格式时间，为空时返回零值
+func parseOptionalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse time %s failed, should be RFC3339 format like 2024-06-19T17:30:00+08:00 %s", s, err)
+	}
+	return t, nil
+}
+
 func pprof(port int) {
 	http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)
 }
@@ -171,30 +343,50 @@ type App struct {
 	source             types.EventSource
 	middlewareHandlers []handler.MiddlewareHandler
 	resultHandlers     []handler.ResultHandler
+	quarantine         *quarantine.Handler
+	session            *session.Handler
+	dispatcher         *session.Dispatcher
+	correlation        *correlation.Handler
+	cacheStat          *cachestat.Handler
 	cancel             func()
-	pool               *ants.Pool
+	pool               *ants.Pool // 启用会话插件时为nil
 	reporter           *statusReporter
 	closeOnce          sync.Once
 }
 
-func newReporter(ctx context.Context, statDuration time.Duration, finalizer func()) *statusReporter {
+func newReporter(ctx context.Context, statDuration time.Duration, sourceStats func() types.SourceStats, finalizer func()) *statusReporter {
 	r := &statusReporter{
 		ctx:    ctx,
 		ticker: *time.NewTicker(statDuration),
 		status: &runningStatus{
-			StartupTime: time.Now(),
+			StartupTime:     time.Now(),
+			ErrReasonCounts: map[types.ErrReason]uint64{},
 		},
-		finalizer: finalizer,
+		sourceStats: sourceStats,
+		finalizer:   finalizer,
 	}
 	go r.loop()
 	return r
 }
 
 type statusReporter struct {
-	ctx       context.Context
-	ticker    time.Ticker
-	status    *runningStatus
-	finalizer func()
+	mu          sync.Mutex
+	ctx         context.Context
+	ticker      time.Ticker
+	status      *runningStatus
+	sourceStats func() types.SourceStats
+	// sessionStats 未启用会话插件时为nil
+	sessionStats func() session.Stats
+	// cacheStats 未启用缓存命中统计插件时为nil
+	cacheStats func() cachestat.Stats
+	finalizer  func()
+}
+
+func (r *statusReporter) addErrEvent(e *types.ErrEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.ErrEventCount += 1
+	r.status.ErrReasonCounts[e.Reason] += 1
 }
 
 func (r *statusReporter) loop() {
@@ -203,7 +395,18 @@ func (r *statusReporter) loop() {
 		case <-r.ticker.C:
 			r.status.RunningTime = time.Since(r.status.StartupTime).String()
 			r.status.AvgEventRate = r.status.TotalEventCount / uint64(time.Since(r.status.StartupTime).Seconds())
+			r.status.SourceStats = r.sourceStats()
+			if r.sessionStats != nil {
+				s := r.sessionStats()
+				r.status.Stats = &s
+			}
+			if r.cacheStats != nil {
+				s := r.cacheStats()
+				r.status.CacheStats = &s
+			}
+			r.mu.Lock()
 			s, _ := json.Marshal(r.status)
+			r.mu.Unlock()
 			logger.Infof("running status: %s", string(s))
 		case <-r.ctx.Done():
 			r.finalizer()
@@ -213,48 +416,81 @@ func (r *statusReporter) loop() {
 }
 
 type runningStatus struct {
-	StartupTime     time.Time `json:"startup_time"`
-	RunningTime     string    `json:"running_time"`
-	TotalEventCount uint64    `json:"total_event_count"`
-	ErrEventCount   uint64    `json:"error_event_count"`
-	AvgEventRate    uint64    `json:"avg_event_rate"`
-	LatestEventTime time.Time `json:"latest_event_time"`
+	StartupTime     time.Time                  `json:"startup_time"`
+	RunningTime     string                     `json:"running_time"`
+	TotalEventCount uint64                     `json:"total_event_count"`
+	ErrEventCount   uint64                     `json:"error_event_count"`
+	ErrReasonCounts map[types.ErrReason]uint64 `json:"error_reason_counts"`
+	AvgEventRate    uint64                     `json:"avg_event_rate"`
+	LatestEventTime time.Time                  `json:"latest_event_time"`
+	types.SourceStats
+	// 未启用会话插件时不输出
+	*session.Stats
+	CacheStats *cachestat.Stats `json:"cache_stats,omitempty"`
 }
 
+// Run 事件及错误事件通道均关闭后处理完已分发的事件再退出，避免会话表中未输出的请求丢失
 func (a *App) Run() {
 	logger.Info("app running")
-	for {
+	events, errEvents := a.source.Events(), a.source.ErrEvents()
+	for events != nil || errEvents != nil {
 		select {
-		case e, ok := <-a.source.Events():
+		case e, ok := <-events:
 			if !ok {
-				a.Close()
-				return
+				events = nil
+				continue
+			}
+			if a.dispatcher != nil {
+				a.dispatcher.Dispatch(e)
+			} else {
+				a.pool.Submit(func() {
+					a.handleFrom(0, e)
+				})
 			}
-			a.pool.Submit(func() {
-				for _, h1 := range a.middlewareHandlers {
-					e = h1.Handle(e)
-				}
-
-				for _, h2 := range a.resultHandlers {
-					h2.Handle(e)
-				}
-			})
 			a.reporter.status.TotalEventCount += 1
 			a.reporter.status.LatestEventTime = e.EventTime
-		case _, ok := <-a.source.ErrEvents():
+		case e, ok := <-errEvents:
 			if !ok {
-				a.Close()
-				return
+				errEvents = nil
+				continue
 			}
-			a.reporter.status.ErrEventCount += 1
+			a.reporter.addErrEvent(e)
+			if a.quarantine != nil {
+				a.quarantine.Handle(e)
+			}
+		}
+	}
+
+	if a.dispatcher != nil {
+		a.dispatcher.Close()
+		a.session.Flush()
+	}
+	a.Close()
+}
+
+// handleFrom 从第i个中间件开始处理事件，中间件返回nil时停止
+func (a *App) handleFrom(i int, e *types.DnsEvent) {
+	for _, h1 := range a.middlewareHandlers[i:] {
+		if e = h1.Handle(e); e == nil {
+			return
 		}
 	}
+
+	for _, h2 := range a.resultHandlers {
+		h2.Handle(e)
+	}
 }
 
 func (a *App) Close() {
 	a.closeOnce.Do(func() {
-		if err := a.pool.ReleaseTimeout(time.Second * 3); err != nil {
-			logger.Errorf("app handler worker pool release timeout %s", err)
+		if a.pool != nil {
+			if err := a.pool.ReleaseTimeout(time.Second * 3); err != nil {
+				logger.Errorf("app handler worker pool release timeout %s", err)
+			}
+		}
+		// 输出关联插件暂存的乱序事件
+		if a.correlation != nil {
+			a.correlation.Flush()
 		}
 		a.cancel()
 		logger.Infof("app groutinue will exit after all handler exited")
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -28,8 +30,38 @@ func Generate(fp string) {
 		PcapFiles: []string{
 			"data.pcap",
 		},
-		Device:             "any",
-		BpfFilter:          "udp and port 53",
+		ReplaySpeed: "max",
+		StartTime:   "",
+		EndTime:     "",
+		SkipPackets: 0,
+		MaxPackets:  0,
+		WatchConfig: WatchConfig{
+			Dir:          "pcaps",
+			Pattern:      "*.pcap",
+			PollInterval: "10s",
+			SettleTime:   "30s",
+			LedgerFile:   "result/watch.ledger",
+			AfterProcess: "keep",
+			MoveDir:      "pcaps/done",
+		},
+		Device:      "any",
+		Devices:     []DeviceConfig{},
+		BpfFilter:   "",
+		DnsPorts:    []uint16{53},
+		KeepRaw:     false,
+		CaptureMode: "pcap",
+		SnapLen:     65535,
+		AfpacketConfig: AfpacketConfig{
+			RingSizeMB:    64,
+			BlockSizeKB:   1024,
+			FanoutGroup:   0,
+			FanoutType:    "hash",
+			FanoutReaders: 1,
+		},
+		DnstapConfig: DnstapConfig{
+			SocketType: "unix",
+			Address:    "/var/run/dnstap.sock",
+		},
 		DecodeWorkerCount:  1,
 		HandlerWorkerCount: 1,
 		MiddlewareHandlers: []MiddlewareHandlerType{
@@ -37,6 +69,8 @@ func Generate(fp string) {
 			IpInfoType,
 			TunnelSecType,
 			TrafficDirectionType,
+			CorrelationType,
+			CacheStatType,
 		},
 		ResultHandlers: []ResultHandlerType{
 			DnsLogWriterType,
@@ -45,6 +79,8 @@ func Generate(fp string) {
 		SessionConfig: SessionConfig{
 			Enable:           true,
 			SessionCacheSize: 100000,
+			QueryTimeout:     "5s",
+			RetryWindow:      "5s",
 		},
 		IpInfoConfig: IpInfoConfig{
 			Enable:        true,
@@ -63,6 +99,18 @@ func Generate(fp string) {
 				"172.31.21.23",
 			},
 		},
+		CorrelationConfig: CorrelationConfig{
+			Enable:        false,
+			Window:        "5s",
+			ReorderWindow: "1s",
+			CacheSize:     100000,
+		},
+		CacheStatConfig: CacheStatConfig{
+			Enable:         false,
+			Window:         "5m",
+			TopDomainCount: 20,
+			MaxDomainCount: 10000,
+		},
 		DnslogConfig: DnslogConfig{
 			Enable:       true,
 			Filename:     "result/dnslog.log",
@@ -78,6 +126,10 @@ func Generate(fp string) {
 			MaxFileCount:       10,
 			MaxRollingInterval: "24h",
 		},
+		QuarantineConfig: QuarantineConfig{
+			Enable:   false,
+			Filename: "result/quarantine.pcapng",
+		},
 		EnableDebug:          false,
 		StatusReportInterval: "10s",
 		PprofEnable:          false,
@@ -95,18 +147,78 @@ func Generate(fp string) {
 	log.Printf("config file %s generated", fp)
 }
 
+// bpfFragmentFilter 非首个IP分片不携带端口信息，需单独放行以便重组，仅放行UDP分片，TCP DNS由MSS分段不依赖IP分片
+const bpfFragmentFilter = "(ip[9] == 17 and ip[6:2] & 0x1fff != 0) or (ip6 and ip6[6] == 44 and ip6[40] == 17)"
+
+// GenerateBpfFilter 按dns_ports生成过滤器，启发式模式下放行全部UDP流量
+func GenerateBpfFilter(dnsPorts []uint16, heuristic bool) string {
+	if len(dnsPorts) == 0 {
+		dnsPorts = []uint16{53}
+	}
+	exprs := []string{}
+	if heuristic {
+		exprs = append(exprs, "udp")
+	}
+	for _, p := range dnsPorts {
+		exprs = append(exprs, fmt.Sprintf("port %d", p))
+	}
+	exprs = append(exprs, bpfFragmentFilter)
+	return strings.Join(exprs, " or ")
+}
+
+// GetDevices 未配置devices时使用device_name，网卡未单独配置bpf_filter时使用全局过滤器
+func (c *Config) GetDevices() []DeviceConfig {
+	devices := c.Devices
+	if len(devices) == 0 {
+		devices = []DeviceConfig{{Name: c.Device}}
+	}
+
+	result := make([]DeviceConfig, 0, len(devices))
+	for _, d := range devices {
+		if d.BpfFilter == "" {
+			d.BpfFilter = c.GetBpfFilter()
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+// GetBpfFilter 未配置bpf_filter时按dns_ports自动生成
+func (c *Config) GetBpfFilter() string {
+	if c.BpfFilter != "" {
+		return c.BpfFilter
+	}
+	return GenerateBpfFilter(c.DnsPorts, c.DnsHeuristic)
+}
+
 type InputType string
 
 const (
 	InputTypePcapFile InputType = "file"
 	InputTypePcap     InputType = "capture"
+	InputTypeDnstap   InputType = "dnstap"
+	InputTypeWatch    InputType = "watch"
 )
 
 type Config struct {
 	InputType              InputType               `yaml:"input_type"`
 	PcapFiles              []string                `yaml:"capture_files"`
+	ReplaySpeed            string                  `yaml:"replay_speed"`
+	StartTime              string                  `yaml:"start_time"`
+	EndTime                string                  `yaml:"end_time"`
+	SkipPackets            uint64                  `yaml:"skip_packets"`
+	MaxPackets             uint64                  `yaml:"max_packets"`
+	WatchConfig            WatchConfig             `yaml:"watch"`
 	Device                 string                  `yaml:"device_name"`
+	Devices                []DeviceConfig          `yaml:"devices"`
 	BpfFilter              string                  `yaml:"bpf_filter"`
+	DnsPorts               []uint16                `yaml:"dns_ports"`
+	DnsHeuristic           bool                    `yaml:"dns_heuristic"`
+	KeepRaw                bool                    `yaml:"keep_raw"`
+	CaptureMode            string                  `yaml:"capture_mode"`
+	SnapLen                int                     `yaml:"snap_len"`
+	AfpacketConfig         AfpacketConfig          `yaml:"afpacket"`
+	DnstapConfig           DnstapConfig            `yaml:"dnstap"`
 	DecodeWorkerCount      int                     `yaml:"decode_worker_count"`
 	HandlerWorkerCount     int                     `yaml:"handler_worker_count"`
 	MiddlewareHandlers     []MiddlewareHandlerType `yaml:"middleware_handlers"`
@@ -115,14 +227,45 @@ type Config struct {
 	IpInfoConfig           IpInfoConfig            `yaml:"ipinfo"`
 	TunnelSecConfig        TunnelSecConfig         `yaml:"tunnel_sec"`
 	TrafficDirectionConfig TrafficDirectionConfig  `yaml:"traffic_direction"`
+	CorrelationConfig      CorrelationConfig       `yaml:"correlation"`
+	CacheStatConfig        CacheStatConfig         `yaml:"cache_stat"`
 	DnslogConfig           DnslogConfig            `yaml:"dnslog"`
 	DnsdbConfig            DnsdbConfig             `yaml:"dnsdb"`
+	QuarantineConfig       QuarantineConfig        `yaml:"quarantine"`
 	EnableDebug            bool                    `yaml:"enable_debug"`
 	StatusReportInterval   string                  `yaml:"status_report_interval"`
 	PprofEnable            bool                    `yaml:"pprof_enable"`
 	PprofHttpPort          int                     `yaml:"pprof_http_port"`
 }
 
+type DeviceConfig struct {
+	Name      string `yaml:"name"`
+	BpfFilter string `yaml:"bpf_filter"`
+}
+
+type WatchConfig struct {
+	Dir          string `yaml:"dir"`
+	Pattern      string `yaml:"pattern"`
+	PollInterval string `yaml:"poll_interval"`
+	SettleTime   string `yaml:"settle_time"`
+	LedgerFile   string `yaml:"ledger_file"`
+	AfterProcess string `yaml:"after_process"`
+	MoveDir      string `yaml:"move_dir"`
+}
+
+type AfpacketConfig struct {
+	RingSizeMB    int    `yaml:"ring_size_mb"`
+	BlockSizeKB   int    `yaml:"block_size_kb"`
+	FanoutGroup   uint16 `yaml:"fanout_group"`
+	FanoutType    string `yaml:"fanout_type"`
+	FanoutReaders int    `yaml:"fanout_readers"`
+}
+
+type DnstapConfig struct {
+	SocketType string `yaml:"socket_type"`
+	Address    string `yaml:"address"`
+}
+
 type MiddlewareHandlerType string
 
 const (
@@ -130,6 +273,8 @@ const (
 	IpInfoType           MiddlewareHandlerType = "ipinfo"
 	TunnelSecType        MiddlewareHandlerType = "tunnel_sec"
 	TrafficDirectionType MiddlewareHandlerType = "traffic_direction"
+	CorrelationType      MiddlewareHandlerType = "correlation"
+	CacheStatType        MiddlewareHandlerType = "cache_stat"
 )
 
 type ResultHandlerType string
@@ -140,8 +285,11 @@ const (
 )
 
 type SessionConfig struct {
-	Enable           bool `yaml:"enable"`
-	SessionCacheSize int  `yaml:"session_cache_size"`
+	Enable           bool   `yaml:"enable"`
+	SessionCacheSize int    `yaml:"session_cache_size"`
+	QueryTimeout     string `yaml:"query_timeout"`
+	TransactionMode  bool   `yaml:"transaction_mode"`
+	RetryWindow      string `yaml:"retry_window"`
 }
 
 type TunnelSecConfig struct {
@@ -157,6 +305,20 @@ type TrafficDirectionConfig struct {
 	SelfIps []string `yaml:"self_ips"`
 }
 
+type CorrelationConfig struct {
+	Enable        bool   `yaml:"enable"`
+	Window        string `yaml:"window"`
+	ReorderWindow string `yaml:"reorder_window"`
+	CacheSize     int    `yaml:"cache_size"`
+}
+
+type CacheStatConfig struct {
+	Enable         bool   `yaml:"enable"`
+	Window         string `yaml:"window"`
+	TopDomainCount int    `yaml:"top_domain_count"`
+	MaxDomainCount int    `yaml:"max_domain_count"`
+}
+
 type IpInfoConfig struct {
 	Enable        bool   `yaml:"enable"`
 	GeoIPFilename string `yaml:"geoip_filename"`
@@ -176,8 +338,15 @@ type LogFormat string
 const (
 	JsonLogFormat LogFormat = "json"
 	CsvLogFormat  LogFormat = "csv"
+	// ProtobufLogFormat 每条记录为varint长度前缀加DnsEvent消息，与protodelim格式一致
+	ProtobufLogFormat LogFormat = "protobuf"
 )
 
+type QuarantineConfig struct {
+	Enable   bool   `yaml:"enable"`
+	Filename string `yaml:"filename"`
+}
+
 type DnsdbConfig struct {
 	Enable             bool   `yaml:"enable"`
 	Filename           string `yaml:"filename"`
@@ -0,0 +1,216 @@
+package cachestat
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+// bucketCount 滚动窗口划分的时间桶数
+const bucketCount = 10
+
+// NewHandler 依赖递归解析关联插件的结果，关联成功的client_response发起过递归时为未命中，
+// 未发起递归但等待期间存在其他请求引发的相同域名及类型的递归时无法区分命中与否，记为未知，其余为命中；
+// 以事件时间为基准统计最近window内的总体及各域名命中率，各时间桶最多统计maxDomainCount个域名，
+// Stats中按请求量输出前topDomainCount个域名
+func NewHandler(ctx context.Context, window time.Duration, topDomainCount int, maxDomainCount int) *Handler {
+	width := window / bucketCount
+	if width <= 0 {
+		width = time.Second
+	}
+	if topDomainCount < 0 {
+		topDomainCount = 0
+	}
+
+	h := &Handler{
+		ctx:            ctx,
+		window:         window,
+		width:          width,
+		topDomainCount: topDomainCount,
+		maxDomainCount: maxDomainCount,
+	}
+	for i := range h.buckets {
+		h.buckets[i].domains = map[string]*counts{}
+	}
+	return h
+}
+
+type Handler struct {
+	ctx            context.Context
+	window         time.Duration
+	width          time.Duration
+	topDomainCount int
+	maxDomainCount int
+
+	mu      sync.Mutex
+	buckets [bucketCount]bucket
+	latest  time.Time
+}
+
+type counts struct {
+	hit     uint64
+	miss    uint64
+	unknown uint64
+}
+
+func (c *counts) add(status string) {
+	switch status {
+	case types.CacheHit:
+		c.hit += 1
+	case types.CacheMiss:
+		c.miss += 1
+	default:
+		c.unknown += 1
+	}
+}
+
+func (c *counts) merge(o *counts) {
+	c.hit += o.hit
+	c.miss += o.miss
+	c.unknown += o.unknown
+}
+
+type bucket struct {
+	start   time.Time
+	total   counts
+	domains map[string]*counts
+}
+
+func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
+	// 未关联到client_query的响应无法判断是否发起过递归
+	if e.TrafficDirection != types.ClientResponseDirection || e.ResolutionId == "" {
+		return e
+	}
+
+	// 多个客户端同时请求时解析器通常只发起一次递归，关联插件将其归属于最早的请求，其余请求同样等待该递归
+	status := types.CacheHit
+	if e.UpstreamQueryCount > 0 {
+		status = types.CacheMiss
+	} else if e.SharedRecursion {
+		status = types.CacheUnknown
+	}
+	e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+		e.CacheStatus = status
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(e.EventTime, e.NormalizedDomain, status)
+	return e
+}
+
+func (h *Handler) add(t time.Time, domain string, status string) {
+	start := t.Truncate(h.width)
+	i := (start.UnixNano() / int64(h.width)) % bucketCount
+	if i < 0 {
+		i += bucketCount
+	}
+
+	b := &h.buckets[i]
+	if !b.start.Equal(start) {
+		// 时间桶已被更新的时间占用，超出窗口的迟到事件不再统计
+		if start.Before(b.start) {
+			return
+		}
+		b.start = start
+		b.total = counts{}
+		b.domains = map[string]*counts{}
+	}
+	if t.After(h.latest) {
+		h.latest = t
+	}
+
+	b.total.add(status)
+	c, ok := b.domains[domain]
+	if !ok {
+		if len(b.domains) >= h.maxDomainCount {
+			return
+		}
+		c = &counts{}
+		b.domains[domain] = c
+	}
+	c.add(status)
+}
+
+// Stats 命中率仅以命中及未命中计算，不含未知
+type Stats struct {
+	Window       string        `json:"window"`
+	HitCount     uint64        `json:"hit_count"`
+	MissCount    uint64        `json:"miss_count"`
+	UnknownCount uint64        `json:"unknown_count"`
+	HitRatio     float64       `json:"hit_ratio"`
+	Domains      []DomainStats `json:"domains"`
+}
+
+type DomainStats struct {
+	Domain       string  `json:"domain"`
+	HitCount     uint64  `json:"hit_count"`
+	MissCount    uint64  `json:"miss_count"`
+	UnknownCount uint64  `json:"unknown_count"`
+	HitRatio     float64 `json:"hit_ratio"`
+}
+
+// Stats 最近window内的命中统计，窗口以已处理的最新事件时间为终点
+func (h *Handler) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	from := h.latest.Truncate(h.width).Add(-h.width * (bucketCount - 1))
+	total := counts{}
+	domains := map[string]*counts{}
+	for i := range h.buckets {
+		b := &h.buckets[i]
+		if b.start.IsZero() || b.start.Before(from) {
+			continue
+		}
+		total.merge(&b.total)
+		for d, c := range b.domains {
+			dc, ok := domains[d]
+			if !ok {
+				dc = &counts{}
+				domains[d] = dc
+			}
+			dc.merge(c)
+		}
+	}
+
+	s := Stats{
+		Window:       h.window.String(),
+		HitCount:     total.hit,
+		MissCount:    total.miss,
+		UnknownCount: total.unknown,
+		HitRatio:     hitRatio(total),
+		Domains:      make([]DomainStats, 0, len(domains)),
+	}
+	for d, c := range domains {
+		s.Domains = append(s.Domains, DomainStats{
+			Domain:       d,
+			HitCount:     c.hit,
+			MissCount:    c.miss,
+			UnknownCount: c.unknown,
+			HitRatio:     hitRatio(*c),
+		})
+	}
+	sort.Slice(s.Domains, func(i, j int) bool {
+		ci := s.Domains[i].HitCount + s.Domains[i].MissCount + s.Domains[i].UnknownCount
+		cj := s.Domains[j].HitCount + s.Domains[j].MissCount + s.Domains[j].UnknownCount
+		if ci != cj {
+			return ci > cj
+		}
+		return s.Domains[i].Domain < s.Domains[j].Domain
+	})
+	if len(s.Domains) > h.topDomainCount {
+		s.Domains = s.Domains[:h.topDomainCount]
+	}
+	return s
+}
+
+func hitRatio(c counts) float64 {
+	if c.hit+c.miss == 0 {
+		return 0
+	}
+	return float64(c.hit) / float64(c.hit+c.miss)
+}
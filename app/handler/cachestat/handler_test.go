@@ -0,0 +1,141 @@
+package cachestat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+func TestCacheStats(t *testing.T) {
+	h := NewHandler(context.Background(), time.Minute, 1, 100)
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	response := func(domain string, upstream uint32, offset time.Duration) *types.DnsEvent {
+		return h.Handle(&types.DnsEvent{
+			EventTime:          base.Add(offset),
+			NormalizedDomain:   domain,
+			TrafficDirection:   types.ClientResponseDirection,
+			ResolutionId:       "1",
+			UpstreamQueryCount: upstream,
+		})
+	}
+
+	if e := response("a.example.", 1, 0); e.CacheStatus != types.CacheMiss {
+		t.Fatalf("expect cache miss, got %s", e.CacheStatus)
+	}
+	if e := response("a.example.", 0, time.Second); e.CacheStatus != types.CacheHit {
+		t.Fatalf("expect cache hit, got %s", e.CacheStatus)
+	}
+	response("a.example.", 0, time.Second*2)
+	response("b.example.", 0, time.Second*3)
+	if e := h.Handle(&types.DnsEvent{TrafficDirection: types.ClientResponseDirection}); e.CacheStatus != "" {
+		t.Fatal("uncorrelated response should not be marked")
+	}
+
+	s := h.Stats()
+	if s.HitCount != 3 || s.MissCount != 1 || s.HitRatio != 0.75 {
+		t.Fatalf("unexpected overall stats %+v", s)
+	}
+	if len(s.Domains) != 1 || s.Domains[0].Domain != "a.example." || s.Domains[0].HitCount != 2 {
+		t.Fatalf("unexpected domain stats %+v", s.Domains)
+	}
+
+	// 窗口滚动后早期的统计不再计入
+	response("b.example.", 1, time.Minute+time.Second*30)
+	s = h.Stats()
+	if s.HitCount != 0 || s.MissCount != 1 || s.Domains[0].Domain != "b.example." {
+		t.Fatalf("unexpected rolled stats %+v", s)
+	}
+}
+
+func TestCacheUnknown(t *testing.T) {
+	h := NewHandler(context.Background(), time.Minute, 1, 100)
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	e := h.Handle(&types.DnsEvent{
+		EventTime:        base,
+		NormalizedDomain: "a.example.",
+		TrafficDirection: types.ClientResponseDirection,
+		ResolutionId:     "1",
+		SharedRecursion:  true,
+	})
+	if e.CacheStatus != types.CacheUnknown {
+		t.Fatalf("expect cache unknown, got %s", e.CacheStatus)
+	}
+	h.Handle(&types.DnsEvent{
+		EventTime:          base,
+		NormalizedDomain:   "a.example.",
+		TrafficDirection:   types.ClientResponseDirection,
+		ResolutionId:       "2",
+		UpstreamQueryCount: 1,
+	})
+
+	// 未知不计入命中率
+	s := h.Stats()
+	if s.HitCount != 0 || s.MissCount != 1 || s.UnknownCount != 1 || s.HitRatio != 0 {
+		t.Fatalf("unexpected overall stats %+v", s)
+	}
+	if s.Domains[0].UnknownCount != 1 {
+		t.Fatalf("unexpected domain stats %+v", s.Domains)
+	}
+}
+
+func TestWindowBoundary(t *testing.T) {
+	// 窗口1分钟，每个时间桶6秒
+	h := NewHandler(context.Background(), time.Minute, 10, 100)
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	hit := func(domain string, offset time.Duration) {
+		h.Handle(&types.DnsEvent{
+			EventTime:        base.Add(offset),
+			NormalizedDomain: domain,
+			TrafficDirection: types.ClientResponseDirection,
+			ResolutionId:     "1",
+		})
+	}
+	domainHits := func(s Stats) map[string]uint64 {
+		m := map[string]uint64{}
+		for _, d := range s.Domains {
+			m[d.Domain] = d.HitCount
+		}
+		return m
+	}
+
+	hit("a.example.", 0)
+	hit("a.example.", time.Second*6-time.Nanosecond) // 首个桶的最后时刻
+	hit("b.example.", time.Second*6)                 // 第二个桶的起点
+	hit("c.example.", time.Minute-time.Nanosecond)   // 窗口内最后一个桶
+	if s := h.Stats(); s.HitCount != 4 {
+		t.Fatalf("expect all events within window, got %+v", s)
+	}
+
+	// 恰好滚动一个窗口，复用首个桶并丢弃其原有统计
+	hit("d.example.", time.Minute)
+	s := h.Stats()
+	m := domainHits(s)
+	if s.HitCount != 3 || m["a.example."] != 0 || m["b.example."] != 1 || m["c.example."] != 1 || m["d.example."] != 1 {
+		t.Fatalf("unexpected stats after rolling %+v", s)
+	}
+
+	// 所属桶已被更新的时间占用的迟到事件不再统计
+	hit("a.example.", time.Second*5)
+	if s := h.Stats(); s.HitCount != 3 {
+		t.Fatalf("late event outside window counted %+v", s)
+	}
+
+	// 窗口内的迟到事件计入原有的桶
+	hit("b.example.", time.Second*7)
+	if s := h.Stats(); s.HitCount != 4 || domainHits(s)["b.example."] != 2 {
+		t.Fatalf("late event within window not counted %+v", s)
+	}
+
+	// 新事件使第二个桶滑出窗口，其统计不再计入但暂不清空
+	hit("d.example.", time.Minute+time.Second*6)
+	s = h.Stats()
+	m = domainHits(s)
+	if s.HitCount != 3 || m["b.example."] != 0 || m["d.example."] != 2 {
+		t.Fatalf("unexpected stats after second rolling %+v", s)
+	}
+}
@@ -0,0 +1,414 @@
+package correlation
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+// NewHandler 依赖流量方向插件给出的TrafficDirection，将同一次递归解析的client_query、
+// 其引发的相同域名及类型的recursion_query/recursion_response以及最终的client_response关联为同一ResolutionId，
+// 超过window未收到client_response的解析不再关联，缓存的解析数超过cacheSize时淘汰最早的解析；
+// 同一解析的各事件属于不同会话流，由不同worker并行处理，到达顺序不确定，reorderWindow大于0时事件先暂存，
+// 以事件时间为序在单一合并点处理，超过reorderWindow后交由emit继续后续插件，Handle返回nil
+func NewHandler(ctx context.Context, window time.Duration, reorderWindow time.Duration, cacheSize int, emit func(*types.DnsEvent)) *Handler {
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	h := &Handler{
+		ctx:           ctx,
+		window:        window,
+		reorderWindow: reorderWindow,
+		cacheSize:     cacheSize,
+		emit:          emit,
+		epoch:         time.Now().UnixNano(),
+		order:         list.New(),
+		pending:       map[questionKey][]*resolution{},
+		clients:       map[flowKey]*resolution{},
+		upstreams:     map[flowKey]*resolution{},
+		done:          make(chan struct{}),
+	}
+	if reorderWindow > 0 {
+		h.loopDone = make(chan struct{})
+		go h.releaseLoop(releaseInterval(reorderWindow))
+	}
+	return h
+}
+
+// releaseInterval 定时释放暂存事件的间隔，不超过1秒
+func releaseInterval(reorderWindow time.Duration) time.Duration {
+	interval := reorderWindow / 5
+	if interval > time.Second {
+		interval = time.Second
+	}
+	if interval < time.Millisecond*10 {
+		interval = time.Millisecond * 10
+	}
+	return interval
+}
+
+type Handler struct {
+	ctx           context.Context
+	window        time.Duration
+	reorderWindow time.Duration
+	cacheSize     int
+	emit          func(*types.DnsEvent)
+	epoch         int64
+	seq           uint64
+
+	mu sync.Mutex
+	// order 按client_query时间先后排列的未完成解析
+	order *list.List
+	// pending 同一域名及类型下未完成的解析
+	pending map[questionKey][]*resolution
+	// clients 以客户端请求流查找解析，用于关联client_response
+	clients map[flowKey]*resolution
+	// upstreams 以递归请求流查找解析，用于关联recursion_response
+	upstreams map[flowKey]*resolution
+
+	// queue 按事件时间排序的暂存事件，latestEvent为已收到的最新事件时间，latestWall为其到达时的墙上时间
+	queue       eventQueue
+	arrival     uint64
+	latestEvent time.Time
+	latestWall  time.Time
+
+	done     chan struct{}
+	loopDone chan struct{} // 定时释放退出后关闭，未开启乱序容忍时为nil
+	stopOnce sync.Once
+}
+
+type questionKey struct {
+	Domain    string
+	QueryType string
+}
+
+// flowKey 请求方向的地址端口及transaction id
+type flowKey struct {
+	SrcIP   string
+	DstIP   string
+	SrcPort uint16
+	DstPort uint16
+	TransID uint16
+	questionKey
+}
+
+type resolution struct {
+	id        string
+	question  questionKey
+	client    flowKey
+	queryTime time.Time
+	elem      *list.Element
+
+	upstreamQueries  uint32
+	upstreamStart    time.Time
+	upstreamEnd      time.Time
+	upstreamFlowKeys []flowKey
+	// sharedRecursion 等待期间相同域名及类型存在由其他解析发起的未完成递归，解析器通常合并为同一递归
+	sharedRecursion bool
+}
+
+func newQuestionKey(e *types.DnsEvent) questionKey {
+	return questionKey{
+		Domain:    strings.ToLower(e.Domain),
+		QueryType: e.QueryType,
+	}
+}
+
+func queryFlowKey(e *types.DnsEvent) flowKey {
+	return flowKey{
+		SrcIP:       e.SourceIP,
+		DstIP:       e.DestinationIP,
+		SrcPort:     e.SourcePort,
+		DstPort:     e.DestinationPort,
+		TransID:     e.TranscationID,
+		questionKey: newQuestionKey(e),
+	}
+}
+
+func responseFlowKey(e *types.DnsEvent) flowKey {
+	return flowKey{
+		SrcIP:       e.DestinationIP,
+		DstIP:       e.SourceIP,
+		SrcPort:     e.DestinationPort,
+		DstPort:     e.SourcePort,
+		TransID:     e.TranscationID,
+		questionKey: newQuestionKey(e),
+	}
+}
+
+func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
+	h.mu.Lock()
+	if h.reorderWindow <= 0 {
+		defer h.mu.Unlock()
+		h.correlate(e)
+		return e
+	}
+
+	h.arrival += 1
+	heap.Push(&h.queue, queuedEvent{e: e, arrival: h.arrival})
+	if e.EventTime.After(h.latestEvent) {
+		h.latestEvent = e.EventTime
+		h.latestWall = time.Now()
+	}
+	ready := h.release(h.latestEvent.Add(-h.reorderWindow))
+	h.mu.Unlock()
+
+	for _, e := range ready {
+		h.emit(e)
+	}
+	return nil
+}
+
+// release 按事件时间顺序关联不晚于deadline的暂存事件，返回待输出的事件
+func (h *Handler) release(deadline time.Time) []*types.DnsEvent {
+	var ready []*types.DnsEvent
+	for h.queue.Len() > 0 && !h.queue[0].e.EventTime.After(deadline) {
+		e := heap.Pop(&h.queue).(queuedEvent).e
+		h.correlate(e)
+		ready = append(ready, e)
+	}
+	return ready
+}
+
+// releaseLoop 定时释放暂存事件，当前时间以最新事件时间加上此后经过的墙上时间推算，避免流量空闲时事件滞留
+func (h *Handler) releaseLoop(interval time.Duration) {
+	defer close(h.loopDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.mu.Lock()
+			var ready []*types.DnsEvent
+			if !h.latestEvent.IsZero() {
+				now := h.latestEvent.Add(time.Since(h.latestWall))
+				ready = h.release(now.Add(-h.reorderWindow))
+			}
+			h.mu.Unlock()
+			for _, e := range ready {
+				h.emit(e)
+			}
+		case <-h.done:
+			return
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush 输入结束时调用，等待定时释放退出后按事件时间顺序输出全部暂存事件
+func (h *Handler) Flush() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+	if h.loopDone != nil {
+		<-h.loopDone
+	}
+
+	h.mu.Lock()
+	var ready []*types.DnsEvent
+	for h.queue.Len() > 0 {
+		e := heap.Pop(&h.queue).(queuedEvent).e
+		h.correlate(e)
+		ready = append(ready, e)
+	}
+	h.mu.Unlock()
+	for _, e := range ready {
+		h.emit(e)
+	}
+}
+
+// correlate 关联单个事件，调用方持有锁
+func (h *Handler) correlate(e *types.DnsEvent) {
+	h.expire(e.EventTime)
+
+	// 会话插件生成的超时事件为原始请求的副本，不发起新的解析，client_query超时即结束对应的解析
+	if e.TimedOut {
+		var r *resolution
+		switch e.TrafficDirection {
+		case types.ClientQueryDirection:
+			if r = h.clients[queryFlowKey(e)]; r != nil {
+				h.close(r)
+			}
+		case types.RecursionQueryDirection:
+			r = h.upstreams[queryFlowKey(e)]
+		}
+		if r != nil {
+			e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+				e.ResolutionId = r.id
+			})
+		}
+		return
+	}
+
+	switch e.TrafficDirection {
+	case types.ClientQueryDirection:
+		r := h.open(e)
+		e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+			e.ResolutionId = r.id
+		})
+	case types.RecursionQueryDirection:
+		r := h.inflight(newQuestionKey(e), e.EventTime)
+		if r == nil {
+			return
+		}
+		k := queryFlowKey(e)
+		r.upstreamQueries += 1
+		if r.upstreamStart.IsZero() {
+			r.upstreamStart = e.EventTime
+		}
+		r.upstreamFlowKeys = append(r.upstreamFlowKeys, k)
+		h.upstreams[k] = r
+		// 递归只关联至最早的解析，同时等待的其他解析同样依赖该递归
+		for _, p := range h.pending[r.question] {
+			if p != r && !p.queryTime.After(e.EventTime) {
+				p.sharedRecursion = true
+			}
+		}
+		e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+			e.ResolutionId = r.id
+		})
+	case types.RecursionResponseDirection:
+		r, ok := h.upstreams[responseFlowKey(e)]
+		if !ok {
+			return
+		}
+		if e.EventTime.After(r.upstreamEnd) {
+			r.upstreamEnd = e.EventTime
+		}
+		e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+			e.ResolutionId = r.id
+		})
+	case types.ClientResponseDirection:
+		r, ok := h.clients[responseFlowKey(e)]
+		if !ok {
+			return
+		}
+		h.close(r)
+		e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+			e.ResolutionId = r.id
+			e.ResolutionMicrosecond = e.EventTime.Sub(r.queryTime).Microseconds()
+			e.UpstreamQueryCount = r.upstreamQueries
+			e.SharedRecursion = r.upstreamQueries == 0 && r.sharedRecursion
+			if !r.upstreamEnd.IsZero() {
+				e.UpstreamMicrosecond = r.upstreamEnd.Sub(r.upstreamStart).Microseconds()
+			}
+		})
+	}
+}
+
+func (h *Handler) open(e *types.DnsEvent) *resolution {
+	if h.order.Len() >= h.cacheSize {
+		logger.Debugf("correlation cache full %d", h.order.Len())
+		h.close(h.order.Front().Value.(*resolution))
+	}
+
+	h.seq += 1
+	r := &resolution{
+		id:        fmt.Sprintf("%x-%x", h.epoch, h.seq),
+		question:  newQuestionKey(e),
+		client:    queryFlowKey(e),
+		queryTime: e.EventTime,
+	}
+	// 同一客户端请求流重复出现时以最新的请求为准
+	if old, ok := h.clients[r.client]; ok {
+		h.close(old)
+	}
+	// 递归已发出但尚未收到响应时到达的请求同样等待该递归
+	for _, p := range h.pending[r.question] {
+		if p.upstreamQueries > 0 && p.upstreamEnd.IsZero() {
+			r.sharedRecursion = true
+			break
+		}
+	}
+	r.elem = h.order.PushBack(r)
+	h.pending[r.question] = append(h.pending[r.question], r)
+	h.clients[r.client] = r
+	return r
+}
+
+// inflight 返回该域名及类型下最早发起且仍在窗口内的未完成解析，多个客户端同时请求时递归通常只由首个请求触发
+func (h *Handler) inflight(k questionKey, now time.Time) *resolution {
+	for _, r := range h.pending[k] {
+		if !r.queryTime.After(now) && now.Sub(r.queryTime) <= h.window {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *Handler) close(r *resolution) {
+	h.order.Remove(r.elem)
+	delete(h.clients, r.client)
+	for _, k := range r.upstreamFlowKeys {
+		if h.upstreams[k] == r {
+			delete(h.upstreams, k)
+		}
+	}
+
+	rs := h.pending[r.question]
+	for i, p := range rs {
+		if p == r {
+			rs = append(rs[:i], rs[i+1:]...)
+			break
+		}
+	}
+	if len(rs) == 0 {
+		delete(h.pending, r.question)
+	} else {
+		h.pending[r.question] = rs
+	}
+}
+
+// expire 以事件时间为基准清理超过window的解析
+func (h *Handler) expire(now time.Time) {
+	deadline := now.Add(-h.window)
+	for {
+		front := h.order.Front()
+		if front == nil {
+			return
+		}
+		r := front.Value.(*resolution)
+		if !r.queryTime.Before(deadline) {
+			return
+		}
+		h.close(r)
+	}
+}
+
+// queuedEvent arrival为到达序号，事件时间相同时按到达顺序处理
+type queuedEvent struct {
+	e       *types.DnsEvent
+	arrival uint64
+}
+
+type eventQueue []queuedEvent
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].e.EventTime.Equal(q[j].e.EventTime) {
+		return q[i].e.EventTime.Before(q[j].e.EventTime)
+	}
+	return q[i].arrival < q[j].arrival
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x any) { *q = append(*q, x.(queuedEvent)) }
+
+func (q *eventQueue) Pop() any {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = queuedEvent{}
+	*q = old[:n-1]
+	return x
+}
@@ -0,0 +1,208 @@
+package correlation
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+func TestResolutionChain(t *testing.T) {
+	h := NewHandler(context.Background(), time.Second*5, 0, 100, nil)
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	event := func(direction string, src string, sport uint16, dst string, dport uint16, id uint16, offset time.Duration) *types.DnsEvent {
+		return &types.DnsEvent{
+			EventTime:        base.Add(offset),
+			SourceIP:         src,
+			SourcePort:       sport,
+			DestinationIP:    dst,
+			DestinationPort:  dport,
+			TranscationID:    id,
+			Domain:           "www.example.com.",
+			QueryType:        "A",
+			TrafficDirection: direction,
+		}
+	}
+
+	cq := h.Handle(event(types.ClientQueryDirection, "10.0.0.1", 40000, "10.0.0.53", 53, 1, 0))
+	// 其他客户端同时发起的相同请求不触发递归
+	other := h.Handle(event(types.ClientQueryDirection, "10.0.0.2", 40000, "10.0.0.53", 53, 1, time.Millisecond))
+	rq := h.Handle(event(types.RecursionQueryDirection, "10.0.0.53", 50000, "192.0.2.1", 53, 7, time.Millisecond*2))
+	rr := h.Handle(event(types.RecursionResponseDirection, "192.0.2.1", 53, "10.0.0.53", 50000, 7, time.Millisecond*32))
+	cr := h.Handle(event(types.ClientResponseDirection, "10.0.0.53", 53, "10.0.0.1", 40000, 1, time.Millisecond*33))
+
+	if cq.ResolutionId == "" || cq.ResolutionId == other.ResolutionId {
+		t.Fatalf("unexpected resolution ids %s %s", cq.ResolutionId, other.ResolutionId)
+	}
+	for _, e := range []*types.DnsEvent{rq, rr, cr} {
+		if e.ResolutionId != cq.ResolutionId {
+			t.Fatalf("%s not correlated: %s", e.TrafficDirection, e.JsonString())
+		}
+	}
+	if cr.ResolutionMicrosecond != 33000 || cr.UpstreamMicrosecond != 30000 || cr.UpstreamQueryCount != 1 {
+		t.Fatalf("unexpected timing %s", cr.JsonString())
+	}
+
+	// 未发起递归的解析上游时间为0，超过窗口的响应不再关联
+	or := h.Handle(event(types.ClientResponseDirection, "10.0.0.53", 53, "10.0.0.2", 40000, 1, time.Millisecond*34))
+	if or.ResolutionId != other.ResolutionId || or.UpstreamMicrosecond != 0 || or.UpstreamQueryCount != 0 {
+		t.Fatalf("unexpected cached resolution %s", or.JsonString())
+	}
+	late := h.Handle(event(types.ClientQueryDirection, "10.0.0.3", 40000, "10.0.0.53", 53, 1, time.Second))
+	if e := h.Handle(event(types.ClientResponseDirection, "10.0.0.53", 53, "10.0.0.3", 40000, 1, time.Second*7)); e.ResolutionId != "" || late.ResolutionId == "" {
+		t.Fatalf("expired resolution should not be correlated %s", e.JsonString())
+	}
+}
+
+func TestOutOfOrderArrival(t *testing.T) {
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	event := func(direction string, src string, sport uint16, dst string, dport uint16, id uint16, offset time.Duration) *types.DnsEvent {
+		return &types.DnsEvent{
+			EventTime:        base.Add(offset),
+			SourceIP:         src,
+			SourcePort:       sport,
+			DestinationIP:    dst,
+			DestinationPort:  dport,
+			TranscationID:    id,
+			Domain:           "www.example.com.",
+			QueryType:        "A",
+			TrafficDirection: direction,
+		}
+	}
+
+	// 各事件属于不同会话流，由不同worker处理时可能以任意顺序到达
+	orders := map[string][]int{
+		"reversed":                {4, 3, 2, 1, 0},
+		"upstream before client":  {1, 2, 0, 3, 4},
+		"response before request": {0, 2, 1, 4, 3},
+	}
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			emitted := []*types.DnsEvent{}
+			h := NewHandler(context.Background(), time.Second*5, time.Second, 100, func(e *types.DnsEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				emitted = append(emitted, e)
+			})
+
+			events := []*types.DnsEvent{
+				event(types.ClientQueryDirection, "10.0.0.1", 40000, "10.0.0.53", 53, 1, 0),
+				event(types.RecursionQueryDirection, "10.0.0.53", 50000, "192.0.2.1", 53, 7, time.Millisecond*2),
+				event(types.RecursionResponseDirection, "192.0.2.1", 53, "10.0.0.53", 50000, 7, time.Millisecond*32),
+				event(types.ClientResponseDirection, "10.0.0.53", 53, "10.0.0.1", 40000, 1, time.Millisecond*33),
+				// 其他客户端的请求，未引发递归
+				event(types.ClientQueryDirection, "10.0.0.2", 40000, "10.0.0.53", 53, 1, time.Millisecond*40),
+			}
+			for _, i := range order {
+				if h.Handle(events[i]) != nil {
+					t.Fatal("event should be held within reorder window")
+				}
+			}
+			// 超过乱序容忍窗口的新事件触发先前事件按时间顺序输出
+			h.Handle(event(types.ClientQueryDirection, "10.0.0.3", 40000, "10.0.0.53", 53, 1, time.Second*2))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(emitted) != len(events) {
+				t.Fatalf("expect %d released events, got %d", len(events), len(emitted))
+			}
+			for i, e := range emitted {
+				if e != events[i] {
+					t.Fatalf("event %d released out of time order: %s", i, e.JsonString())
+				}
+			}
+			cq, cr := events[0], events[3]
+			for _, e := range events[1:4] {
+				if e.ResolutionId == "" || e.ResolutionId != cq.ResolutionId {
+					t.Fatalf("%s not correlated: %s", e.TrafficDirection, e.JsonString())
+				}
+			}
+			if cr.ResolutionMicrosecond != 33000 || cr.UpstreamMicrosecond != 30000 || cr.UpstreamQueryCount != 1 {
+				t.Fatalf("unexpected timing %s", cr.JsonString())
+			}
+			if events[4].ResolutionId == "" || events[4].ResolutionId == cq.ResolutionId {
+				t.Fatalf("unexpected resolution of other client %s", events[4].JsonString())
+			}
+		})
+	}
+}
+
+func TestReorderFlush(t *testing.T) {
+	emitted := make(chan *types.DnsEvent, 10)
+	h := NewHandler(context.Background(), time.Second*5, time.Second, 100, func(e *types.DnsEvent) {
+		emitted <- e
+	})
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	q := &types.DnsEvent{EventTime: base, SourceIP: "10.0.0.1", SourcePort: 40000, DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: 1, Domain: "www.example.com.", QueryType: "A", TrafficDirection: types.ClientQueryDirection}
+	h.Handle(q)
+
+	// 无后续事件时由定时任务释放
+	select {
+	case e := <-emitted:
+		if e != q || e.ResolutionId == "" {
+			t.Fatalf("unexpected released event %s", e.JsonString())
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("held event not released")
+	}
+
+	// 会话插件的超时事件结束解析，不发起新的解析，Flush输出全部暂存事件
+	timeout := *q
+	timeout.TimedOut = true
+	h.Handle(&timeout)
+	h.Flush()
+	e := <-emitted
+	if e.ResolutionId != q.ResolutionId {
+		t.Fatalf("timed out query should keep resolution %s", e.JsonString())
+	}
+	r := &types.DnsEvent{EventTime: base.Add(time.Millisecond), SourceIP: "10.0.0.53", SourcePort: 53, DestinationIP: "10.0.0.1", DestinationPort: 40000, TranscationID: 1, Domain: "www.example.com.", QueryType: "A", TrafficDirection: types.ClientResponseDirection}
+	h.Handle(r)
+	h.Flush()
+	if e := <-emitted; e.ResolutionId != "" {
+		t.Fatalf("response after timeout should not be correlated %s", e.JsonString())
+	}
+}
+
+func TestSharedRecursion(t *testing.T) {
+	h := NewHandler(context.Background(), time.Second*5, 0, 100, nil)
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	event := func(direction string, src string, sport uint16, dst string, dport uint16, offset time.Duration) *types.DnsEvent {
+		return h.Handle(&types.DnsEvent{
+			EventTime:        base.Add(offset),
+			SourceIP:         src,
+			SourcePort:       sport,
+			DestinationIP:    dst,
+			DestinationPort:  dport,
+			TranscationID:    1,
+			Domain:           "www.example.com.",
+			QueryType:        "A",
+			TrafficDirection: direction,
+		})
+	}
+
+	// a、b先后请求，解析器只为a发起一次递归；c在递归未完成时请求；d在递归响应后请求
+	clients := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	event(types.ClientQueryDirection, clients[0], 40000, "10.0.0.53", 53, 0)
+	event(types.ClientQueryDirection, clients[1], 40000, "10.0.0.53", 53, time.Millisecond)
+	event(types.RecursionQueryDirection, "10.0.0.53", 50000, "192.0.2.1", 53, time.Millisecond*2)
+	event(types.ClientQueryDirection, clients[2], 40000, "10.0.0.53", 53, time.Millisecond*10)
+	event(types.RecursionResponseDirection, "192.0.2.1", 53, "10.0.0.53", 50000, time.Millisecond*30)
+	event(types.ClientQueryDirection, clients[3], 40000, "10.0.0.53", 53, time.Millisecond*31)
+
+	expect := []struct {
+		upstream uint32
+		shared   bool
+	}{{1, false}, {0, true}, {0, true}, {0, false}}
+	for i, c := range clients {
+		r := event(types.ClientResponseDirection, "10.0.0.53", 53, c, 40000, time.Millisecond*(32+time.Duration(i)))
+		if r.ResolutionId == "" || r.UpstreamQueryCount != expect[i].upstream || r.SharedRecursion != expect[i].shared {
+			t.Fatalf("unexpected response to %s %s", c, r.JsonString())
+		}
+	}
+}
@@ -110,44 +110,7 @@ func (w *DbRollingWriter) Write(e *types.DnsEvent) {
 }
 
 func (w *DbRollingWriter) writeEvent(e *types.DnsEvent) error {
-	return w.appender.AppendRow(e.EventTime,
-		e.SourceIP,
-		e.SourcePort,
-		e.DestinationIP,
-		e.DestinationPort,
-		e.TranscationID,
-		e.View,
-		e.Domain,
-		e.QueryClass,
-		e.QueryType,
-		e.Rcode,
-		e.Response,
-		e.Authoritative,
-		e.Truncated,
-		e.RecursionDesired,
-		e.RecursionAvailable,
-		e.Zero,
-		e.AuthenticatedData,
-		e.CheckingDisabled,
-		e.DelayMicrosecond,
-		e.Answer,
-		e.Authority,
-		e.Additional,
-		e.Edns,
-		e.EdnsClientSubnet,
-		e.EdnsClientSubnetInfo,
-		e.SourceIpInfo,
-		e.AnswerIP,
-		e.AnswerIpInfo,
-		e.SecondLevelDomain,
-		e.ByteLength,
-		e.QueryByteLength,
-		e.SubdomainByteLength,
-		e.LabelCount,
-		e.SubdomainLabelCount,
-		e.SubdomainEntropy,
-		e.SubdomainLabelEncoded,
-		e.TrafficDirection)
+	return w.appender.AppendRow(e.DbValues()...)
 }
 
 func (w *DbRollingWriter) Roll() error {
@@ -229,94 +192,7 @@ func (w *DbRollingWriter) checkCountAndRemoveIfNeed() {
 }
 
 func (w *DbRollingWriter) initNew() {
-	var sql string = `CREATE TABLE IF NOT EXISTS dnsevent (
-    EventTime DATETIME,
-    SourceIP VARCHAR,
-    SourcePort USMALLINT,
-    DestinationIP VARCHAR,
-    DestinationPort USMALLINT,
-    TranscationID USMALLINT,
-	View VARCHAR,
-    Domain VARCHAR,
-    QueryClass VARCHAR,
-    QueryType VARCHAR,
-    Rcode VARCHAR,
-    Response BOOLEAN,
-    Authoritative BOOLEAN,
-    Truncated BOOLEAN,
-    RecursionDesired BOOLEAN,
-    RecursionAvailable BOOLEAN,
-    Zero BOOLEAN,
-    AuthenticatedData BOOLEAN,
-    CheckingDisabled BOOLEAN,
-    DelayMicrosecond BIGINT,
-    Answer STRUCT(
-        Domain VARCHAR, 
-        TTL UINTEGER,
-        Rclass VARCHAR,
-        Rtype VARCHAR,
-        Rdata VARCHAR
-        )[],
-    Authority STRUCT(
-        Domain VARCHAR, 
-        TTL UINTEGER,
-        Rclass VARCHAR,
-        Rtype VARCHAR,
-        Rdata VARCHAR
-        )[],
-    Additional STRUCT(
-        Domain VARCHAR, 
-        TTL UINTEGER,
-        Rclass VARCHAR,
-        Rtype VARCHAR,
-        Rdata VARCHAR
-        )[],
-    Edns VARCHAR,
-    EdnsClientSubnet VARCHAR,
-    EdnsClientSubnetInfo STRUCT(
-        IP VARCHAR,
-        Country VARCHAR,
-        Province VARCHAR,
-        City VARCHAR,
-		County VARCHAR,
-        Isp VARCHAR,
-        DC VARCHAR,
-        App VARCHAR,
-        Custom VARCHAR
-    ),
-    SourceIpInfo STRUCT(
-        IP VARCHAR,
-        Country VARCHAR,
-        Province VARCHAR,
-        City VARCHAR,
-		County VARCHAR,
-        Isp VARCHAR,
-        DC VARCHAR,
-        App VARCHAR,
-        Custom VARCHAR
-    ),
-	AnswerIP VARCHAR,
-    AnswerIpInfo STRUCT(
-        IP VARCHAR,
-        Country VARCHAR,
-        Province VARCHAR,
-        City VARCHAR,
-		County VARCHAR,
-        Isp VARCHAR,
-        DC VARCHAR,
-        App VARCHAR,
-        Custom VARCHAR
-    ),
-	SecondLevelDomain VARCHAR,
-	ByteLength UINTEGER,
-	QueryByteLength UINTEGER,
-	SubdomainByteLength UINTEGER,
-	LabelCount UINTEGER,
-	SubdomainLabelCount UINTEGER,
-	SubdomainEntropy DOUBLE,
-	SubdomainLabelEncoded BOOLEAN,
-	TrafficDirection VARCHAR
-)`
+	sql := types.DnsEventDDL(tableName)
 	connector, err := duckdb.NewConnector(w.filename, func(execer driver.ExecerContext) error {
 		_, err := execer.ExecContext(context.Background(), sql, []driver.NamedValue{})
 		return err
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/natefinch/lumberjack"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/hiwyw/dnscap-tool/app/logger"
 	"github.com/hiwyw/dnscap-tool/app/types"
@@ -45,7 +47,7 @@ func NewHandler(ctx context.Context, filename string, maxsize, fileCount, fileAg
 		format: format,
 	}
 	switch format {
-	case "json":
+	case "json", "protobuf":
 		h.ch = make(chan string, recviceBufferLength)
 		h.buffer = bufio.NewWriterSize(h.writer, writerBuffSize)
 	case "csv":
@@ -58,7 +60,7 @@ func NewHandler(ctx context.Context, filename string, maxsize, fileCount, fileAg
 }
 
 func (h *LogHandler) loop() {
-	if h.format == "json" {
+	if h.format == "json" || h.format == "protobuf" {
 		for {
 			select {
 			case s, ok := <-h.ch:
@@ -107,6 +109,14 @@ func (h *LogHandler) Handle(e *types.DnsEvent) {
 		h.ch <- e.JsonString() + "\n"
 	case "csv":
 		h.csvCh <- e.CsvStrings()
+	case "protobuf":
+		b, err := proto.Marshal(e.ProtoMessage())
+		if err != nil {
+			logger.Errorf("marshal protobuf event failed %s", err)
+			return
+		}
+		// 长度前缀分隔，与protodelim格式一致
+		h.ch <- string(protowire.AppendBytes(nil, b))
 	default:
 		logger.Fatalf("unknown format: %s", h.format)
 	}
@@ -118,7 +128,18 @@ func (h *LogHandler) writeCsv(ss []string) {
 	}
 }
 
+// writeStr 缓冲区只在记录之间刷新，每次写入文件的均为完整记录，文件按大小滚动时不会截断记录
 func (h *LogHandler) writeStr(s string) {
+	if len(s) > h.buffer.Available() {
+		h.flush()
+	}
+	if len(s) > h.buffer.Available() {
+		// 超过缓冲区大小的记录单独写入
+		if _, err := h.writer.Write([]byte(s)); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
 	if _, err := h.buffer.WriteString(s); err != nil {
 		logger.Fatal(err)
 	}
@@ -2,15 +2,76 @@ package dnslog
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/hiwyw/dnscap-tool/app/types"
 	"github.com/natefinch/lumberjack"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
+func TestProtobufRotation(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	h := NewHandler(ctx, filepath.Join(dir, "dnslog.pb"), 1, 10, 0, "protobuf", func() {
+		close(done)
+	})
+	// 滚动后的文件不压缩，便于直接读取
+	h.writer.Compress = false
+
+	// 记录大小不整除缓冲区及文件大小，共约5MB，滚动多次
+	const count = 1000
+	for i := 0; i < count; i++ {
+		h.Handle(&types.DnsEvent{
+			EventTime: time.Unix(1718790000, int64(i)),
+			Domain:    "www.example.com.",
+			Raw:       make([]byte, 5001+i%7),
+		})
+	}
+	for len(h.ch) > 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	<-done
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("expect rotated files, got %v", files)
+	}
+	total := 0
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 各文件均以完整的长度前缀记录开始及结束
+		for len(b) > 0 {
+			record, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("%s broken framing at record %d", f, total)
+			}
+			if err := proto.Unmarshal(record, (&types.DnsEvent{}).ProtoMessage()); err != nil {
+				t.Fatalf("%s unmarshal record failed %s", f, err)
+			}
+			b = b[n:]
+			total += 1
+		}
+	}
+	if total != count {
+		t.Fatalf("expect %d records, got %d", count, total)
+	}
+}
+
 func BenchmarkDnslogWrite(b *testing.B) {
 	jsonStr := `{"EventTime":"2023-09-07T09:57:20.631236+08:00","SourceIP":"2a01:111:4000:10::2","SourcePort":53,"DestinationIP":"fec0:0:0:21::23","DestinationPort":47628,"TranscationID":54835,"View":"","Domain":"onedscolprdwus01.westus.cloudapp.azure.com.","QueryClass":"IN","QueryType":"A","Rcode":"NOERROR","Response":true,"Authoritative":true,"Truncated":false,"RecursionDesired":false,"RecursionAvailable":false,"Zero":false,"AuthenticatedData":true,"CheckingDisabled":false,"DelayMicrosecond":0,"Answer":[{"Domain":"onedscolprdwus01.westus.cloudapp.azure.com.","TTL":10,"Rclass":"IN","Rtype":"A","Rdata":"20.189.173.2"}],"Authority":[],"Additional":[],"Edns":";; OPT PSEUDOSECTION:; EDNS: version 0; flags:; udp: 1232","EdnsClientSubnet":"","EdnsClientSubnetInfo":{"IP":"","Country":"","Province":"","City":"","County":"","Isp":"","DC":"","App":"","Custom":""},"SourceIpInfo":{"IP":"2a01:111:4000:10::2","Country":"英国","Province":"","City":"","County":"","Isp":"","DC":"","App":"","Custom":""},"AnswerIP":"20.189.173.2","AnswerIpInfo":{"IP":"20.189.173.2","Country":"保留IP","Province":"","City":"","County":"","Isp":"","DC":"","App":"","Custom":""},"SecondLevelDomain":"azure.com.","ByteLength":129,"SubdomainByteLength":34,"LabelCount":6,"SubdomainLabelCount":4,"SubdomainEntropy":3.8431390622295662,"SubdomainLabelEncoded":true,"TrafficDirection":""}`
 
@@ -4,6 +4,7 @@ import (
 	"github.com/hiwyw/dnscap-tool/app/types"
 )
 
+// MiddlewareHandler 返回nil表示事件已被缓存或合并，不再继续处理
 type MiddlewareHandler interface {
 	Handle(e *types.DnsEvent) *types.DnsEvent
 }
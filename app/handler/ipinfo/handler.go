@@ -103,6 +103,22 @@ func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
 		}
 	}
 
+	if len(e.AnswerIPs) > 0 {
+		infos := make([]types.IpInfo, 0, len(e.AnswerIPs))
+		for _, ip := range e.AnswerIPs {
+			r, ok := h.search(net.ParseIP(ip))
+			if !ok {
+				// 未匹配的地址保留IP，与AnswerIPs保持一一对应
+				infos = append(infos, types.IpInfo{IP: ip})
+				continue
+			}
+			infos = append(infos, subnetInfo2Ipinfo(ip, &r))
+		}
+		e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+			e.AnswerIpInfos = infos
+		})
+	}
+
 	if e.EdnsClientSubnet == "" {
 		return e
 	}
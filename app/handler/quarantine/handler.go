@@ -0,0 +1,139 @@
+package quarantine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+const (
+	recviceBufferLength = 10
+	flushInterval       = time.Second * 3
+)
+
+// pcapng接口按网卡、链路类型及错误原因区分，错误原因记录在接口描述中
+type interfaceKey struct {
+	iface    string
+	linkType layers.LinkType
+	reason   types.ErrReason
+}
+
+// Handler 将解析失败的原始数据包写入pcapng隔离文件，便于离线分析
+type Handler struct {
+	ctx        context.Context
+	finalizer  func()
+	filename   string
+	file       *os.File
+	writer     *pcapgo.NgWriter
+	ch         chan *types.ErrEvent
+	interfaces map[interfaceKey]int
+}
+
+func NewHandler(ctx context.Context, filename string, finalizer func()) *Handler {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		logger.Fatalf("create quarantine dir failed %s", err)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		logger.Fatalf("create quarantine file %s failed %s", filename, err)
+	}
+
+	h := &Handler{
+		ctx:        ctx,
+		finalizer:  finalizer,
+		filename:   filename,
+		file:       f,
+		ch:         make(chan *types.ErrEvent, recviceBufferLength),
+		interfaces: map[interfaceKey]int{},
+	}
+	go h.loop()
+	return h
+}
+
+// Handle 无原始数据的错误事件（TCP流、dnstap）直接忽略
+func (h *Handler) Handle(e *types.ErrEvent) {
+	if len(e.Data) == 0 {
+		return
+	}
+	select {
+	case h.ch <- e:
+	case <-h.ctx.Done():
+	}
+}
+
+func (h *Handler) loop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-h.ch:
+			if err := h.write(e); err != nil {
+				logger.Errorf("write quarantine packet failed %s", err)
+			}
+		case <-ticker.C:
+			h.flush()
+		case <-h.ctx.Done():
+			h.flush()
+			h.file.Close()
+			logger.Infof("quarantine handler exiting by recvice signal")
+			h.finalizer()
+			logger.Infof("quarantine handler finalizer succeed")
+			return
+		}
+	}
+}
+
+func (h *Handler) write(e *types.ErrEvent) error {
+	k := interfaceKey{iface: e.Interface, linkType: e.LinkType, reason: e.Reason}
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = e.Interface
+	if intf.Name == "" {
+		intf.Name = "file"
+	}
+	intf.LinkType = e.LinkType
+	intf.Description = string(e.Reason)
+
+	id, ok := h.interfaces[k]
+	if !ok {
+		if h.writer == nil {
+			w, err := pcapgo.NewNgWriterInterface(h.file, intf, pcapgo.DefaultNgWriterOptions)
+			if err != nil {
+				return err
+			}
+			h.writer = w
+			id = 0
+		} else {
+			var err error
+			if id, err = h.writer.AddInterface(intf); err != nil {
+				return err
+			}
+		}
+		h.interfaces[k] = id
+	}
+
+	ci := e.CaptureInfo
+	ci.InterfaceIndex = id
+	if ci.CaptureLength != len(e.Data) {
+		ci.CaptureLength = len(e.Data)
+	}
+	if ci.Length < ci.CaptureLength {
+		ci.Length = ci.CaptureLength
+	}
+	return h.writer.WritePacket(ci, e.Data)
+}
+
+func (h *Handler) flush() {
+	if h.writer == nil {
+		return
+	}
+	if err := h.writer.Flush(); err != nil {
+		logger.Errorf("flush quarantine file %s failed %s", h.filename, err)
+	}
+}
@@ -2,6 +2,8 @@ package session
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -10,23 +12,103 @@ import (
 	"github.com/hiwyw/dnscap-tool/app/types"
 )
 
-func NewHandler(ctx context.Context, sessionCaheSize int) *Handler {
+// NewHandler queryTimeout大于0时，超时未响应的请求生成TimedOut事件交由emit输出；
+// transaction开启时请求暂存不输出，匹配到响应后合并为一条事务记录，未匹配的请求及响应单独输出并标记状态；
+// retryWindow大于0时识别同一客户端的重传请求及重复响应；
+// 会话表按FlowHash分为shardCount个分片，各分片独立加锁，可与Dispatcher配合并行处理；
+// 除新事件触发外，各分片另由定时任务检查超时，避免无新事件的分片延迟输出
+func NewHandler(ctx context.Context, sessionCaheSize int, shardCount int, dnsPorts []uint16, queryTimeout time.Duration, retryWindow time.Duration, transaction bool, emit func(*types.DnsEvent)) *Handler {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shardCacheSize := sessionCaheSize / shardCount
+	if shardCacheSize < 1 {
+		shardCacheSize = 1
+	}
+
 	h := &Handler{
-		ctx:            ctx,
-		sessionManager: NewSessionCache(sessionCaheSize),
+		ctx:          ctx,
+		shards:       make([]*shard, shardCount),
+		dnsPorts:     types.NewPortSet(dnsPorts),
+		queryTimeout: queryTimeout,
+		transaction:  transaction,
+		emit:         emit,
+		done:         make(chan struct{}),
+	}
+	for i := range h.shards {
+		h.shards[i] = &shard{cache: NewSessionCache(shardCacheSize)}
+	}
+	if retryWindow > 0 {
+		h.retries = newRetryTracker(shardCacheSize*shardCount, retryWindow)
 	}
 
+	if queryTimeout > 0 {
+		h.loopDone = make(chan struct{})
+		go h.expireLoop(expireInterval(queryTimeout))
+	}
 	return h
 }
 
+// expireInterval 定时超时检查间隔，不超过1秒
+func expireInterval(queryTimeout time.Duration) time.Duration {
+	interval := queryTimeout / 5
+	if interval > time.Second {
+		interval = time.Second
+	}
+	if interval < time.Millisecond*10 {
+		interval = time.Millisecond * 10
+	}
+	return interval
+}
+
 type Handler struct {
-	ctx            context.Context
-	sessionManager *SessionCache
+	ctx          context.Context
+	shards       []*shard
+	retries      *retryTracker // 未开启重传识别时为nil
+	dnsPorts     types.PortSet
+	queryTimeout time.Duration
+	transaction  bool
+	emit         func(*types.DnsEvent)
+	timeoutCount atomic.Uint64
+	evictedCount atomic.Uint64
+
+	// clockMu 保护最新事件时间及其到达时的墙上时间，定时检查据此推算当前事件时间
+	clockMu     sync.Mutex
+	latestEvent time.Time
+	latestWall  time.Time
+
+	done     chan struct{}
+	loopDone chan struct{} // 定时检查退出后关闭，未开启超时检查时为nil
+	stopOnce sync.Once
+}
+
+type Stats struct {
+	TimeoutCount uint64 `json:"session_timeout_count"`
+	EvictedCount uint64 `json:"session_evicted_count"`
+}
+
+func (h *Handler) Stats() Stats {
+	return Stats{
+		TimeoutCount: h.timeoutCount.Load(),
+		EvictedCount: h.evictedCount.Load(),
+	}
 }
 
 func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
+	h.observe(e.EventTime)
+
+	s := h.shards[FlowHash(e)%uint32(len(h.shards))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h.expire(s.cache, e.EventTime)
+
 	switch e.Response {
 	case false:
+		// 仅缓存发往DNS端口的请求，启发式解析出的非DNS端口事件不参与会话匹配
+		if !h.dnsPorts.Contains(e.DestinationPort) {
+			return e
+		}
 		k := SessionKey{
 			SrcIP:     e.SourceIP,
 			DstIP:     e.DestinationIP,
@@ -37,14 +119,42 @@ func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
 			QueryType: e.QueryType,
 		}
 
-		if ok := h.sessionManager.Add(k, SessionValue{
+		// 事务模式下请求未输出，需在被挤出前主动淘汰并单独输出
+		var attempt uint32
+		if h.retries != nil {
+			attempt = h.retries.query(e)
+			e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+				e.Attempt = attempt
+				e.Retransmission = attempt > 1
+			})
+		}
+
+		if h.transaction && s.cache.Full() && !s.cache.Contains(k) {
+			if oldest, v, ok := s.cache.Oldest(); ok {
+				s.cache.Delete(oldest)
+				h.evictedCount.Add(1)
+				h.emit(queryOnly(v.Query, false))
+			}
+		}
+
+		if ok := s.cache.Add(k, SessionValue{
 			QueryTime:  e.EventTime,
 			ByteLength: e.ByteLength,
+			Attempt:    attempt,
+			Query:      e,
 		}); ok {
-			logger.Debugf("session cache full %d", h.sessionManager.c.Len())
+			// 缓存容量不足被挤出的请求不视为超时
+			h.evictedCount.Add(1)
+			logger.Debugf("session cache full %d", s.cache.c.Len())
+		}
+		if h.transaction {
+			return nil
 		}
 		return e
 	case true:
+		if !h.dnsPorts.Contains(e.SourcePort) {
+			return e
+		}
 		k := SessionKey{
 			SrcIP:     e.DestinationIP,
 			DstIP:     e.SourceIP,
@@ -55,33 +165,181 @@ func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
 			QueryType: e.QueryType,
 		}
 
-		v, ok := h.sessionManager.Get(k)
+		v, ok := s.cache.Get(k)
 		if !ok {
 			logger.Debugf("session fetch failed due to not found: %v", k)
+			duplicate := h.retries != nil && h.retries.duplicate(k, e)
+			e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
+				e.DuplicateResponse = duplicate
+				if h.transaction {
+					e.TransactionStatus = types.TransactionResponseOnly
+					e.ResponseTime = e.EventTime
+				}
+			})
 			return e
 		}
 
+		var firstAnswer time.Duration
+		var first bool
+		if h.retries != nil {
+			firstAnswer, first = h.retries.answer(k, e)
+		}
+
 		e.ExecMiddlewareFunc(func(e *types.DnsEvent) {
 			e.DelayMicrosecond = e.EventTime.Sub(v.QueryTime).Microseconds()
 			e.QueryByteLength = v.ByteLength
+			e.Attempt = v.Attempt
+			e.Retransmission = v.Attempt > 1
+			if first {
+				e.FirstAnswerDelayMicrosecond = firstAnswer.Microseconds()
+			}
+			if h.transaction {
+				e.TransactionStatus = types.TransactionMatched
+				e.QueryTime = v.QueryTime
+				e.ResponseTime = e.EventTime
+				e.QueryRecursionDesired = v.Query.RecursionDesired
+				e.QueryCheckingDisabled = v.Query.CheckingDisabled
+				e.QueryAuthenticatedData = v.Query.AuthenticatedData
+				e.QueryEdnsDo = v.Query.EdnsDo
+			}
 		})
 
-		h.sessionManager.Delete(k)
+		s.cache.Delete(k)
 		return e
 	}
 	return e
 }
 
+// expire 以事件时间为基准清理超过queryTimeout的请求，离线文件与实时抓包行为一致，
+// 缓存按请求时间先后淘汰，遇到未超时的请求即停止
+func (h *Handler) expire(c *SessionCache, now time.Time) {
+	if h.queryTimeout <= 0 {
+		return
+	}
+
+	deadline := now.Add(-h.queryTimeout)
+	for {
+		k, v, ok := c.Oldest()
+		if !ok || !v.QueryTime.Before(deadline) {
+			return
+		}
+		c.Delete(k)
+		h.timeoutCount.Add(1)
+
+		h.emit(h.timedOut(v.Query))
+	}
+}
+
+func (h *Handler) observe(t time.Time) {
+	h.clockMu.Lock()
+	defer h.clockMu.Unlock()
+	if t.After(h.latestEvent) {
+		h.latestEvent = t
+		h.latestWall = time.Now()
+	}
+}
+
+// now 以最新事件时间加上此后经过的墙上时间作为当前事件时间，未收到事件时返回零值
+func (h *Handler) now() time.Time {
+	h.clockMu.Lock()
+	defer h.clockMu.Unlock()
+	if h.latestEvent.IsZero() {
+		return time.Time{}
+	}
+	return h.latestEvent.Add(time.Since(h.latestWall))
+}
+
+// expireLoop 定时检查全部分片的超时请求，Flush或ctx结束后退出
+func (h *Handler) expireLoop(interval time.Duration) {
+	defer close(h.loopDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := h.now()
+			if now.IsZero() {
+				continue
+			}
+			for _, s := range h.shards {
+				s.mu.Lock()
+				h.expire(s.cache, now)
+				s.mu.Unlock()
+			}
+		case <-h.done:
+			return
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// Flush 输入结束时调用，等待定时检查退出后将缓存中全部未响应的请求按超时输出
+func (h *Handler) Flush() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+	if h.loopDone != nil {
+		<-h.loopDone
+	}
+	for _, s := range h.shards {
+		s.mu.Lock()
+		for {
+			k, v, ok := s.cache.Oldest()
+			if !ok {
+				break
+			}
+			s.cache.Delete(k)
+			h.timeoutCount.Add(1)
+			h.emit(h.timedOut(v.Query))
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (h *Handler) timedOut(q *types.DnsEvent) *types.DnsEvent {
+	if h.transaction {
+		return queryOnly(q, true)
+	}
+	// 原始请求事件可能仍被其他结果插件引用，复制后再标记
+	timeout := *q
+	timeout.TimedOut = true
+	return &timeout
+}
+
+// queryOnly 事务模式下未匹配到响应的请求记录
+func queryOnly(q *types.DnsEvent, timedOut bool) *types.DnsEvent {
+	e := *q
+	e.TimedOut = timedOut
+	e.TransactionStatus = types.TransactionQueryOnly
+	e.QueryTime = q.EventTime
+	e.QueryRecursionDesired = q.RecursionDesired
+	e.QueryCheckingDisabled = q.CheckingDisabled
+	e.QueryAuthenticatedData = q.AuthenticatedData
+	e.QueryEdnsDo = q.EdnsDo
+	return &e
+}
+
 func NewSessionCache(size int) *SessionCache {
 	lruc, _ := lru.New(size)
 
 	return &SessionCache{
-		c: lruc,
+		c:    lruc,
+		size: size,
 	}
 }
 
 type SessionCache struct {
-	c *lru.Cache
+	c    *lru.Cache
+	size int
+}
+
+func (s *SessionCache) Full() bool {
+	return s.c.Len() >= s.size
+}
+
+func (s *SessionCache) Contains(k SessionKey) bool {
+	return s.c.Contains(k)
 }
 
 func (s *SessionCache) Add(k SessionKey, v SessionValue) (evicted bool) {
@@ -93,6 +351,14 @@ func (s *SessionCache) Delete(k SessionKey) {
 	s.c.Remove(k)
 }
 
+func (s *SessionCache) Oldest() (SessionKey, SessionValue, bool) {
+	k, v, ok := s.c.GetOldest()
+	if !ok {
+		return SessionKey{}, SessionValue{}, false
+	}
+	return k.(SessionKey), v.(SessionValue), true
+}
+
 func (s *SessionCache) Get(k SessionKey) (SessionValue, bool) {
 	v, ok := s.c.Peek(k)
 	if !ok {
@@ -114,4 +380,6 @@ type SessionKey struct {
 type SessionValue struct {
 	QueryTime  time.Time
 	ByteLength uint32
+	Attempt    uint32
+	Query      *types.DnsEvent
 }
@@ -0,0 +1,230 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	emitted := []*types.DnsEvent{}
+	h := NewHandler(context.Background(), 1, 1, []uint16{53}, time.Second*5, 0, false, func(e *types.DnsEvent) {
+		emitted = append(emitted, e)
+	})
+	defer h.Flush()
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	query := func(id uint16, t time.Time) *types.DnsEvent {
+		return &types.DnsEvent{EventTime: t, SourceIP: "10.0.0.1", SourcePort: 40000, DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: id, Domain: "example.com."}
+	}
+
+	q1 := query(1, base)
+	h.Handle(q1)
+	// 缓存容量为1，第二个请求挤出第一个
+	h.Handle(query(2, base.Add(time.Second)))
+	h.Handle(query(3, base.Add(time.Second*10)))
+
+	if len(emitted) != 1 || emitted[0].TranscationID != 2 || !emitted[0].TimedOut {
+		t.Fatalf("unexpected timeout events %v", emitted)
+	}
+	if q1.TimedOut {
+		t.Fatal("original query event should not be modified")
+	}
+	if s := h.Stats(); s.TimeoutCount != 1 || s.EvictedCount != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestTransactionMode(t *testing.T) {
+	emitted := []*types.DnsEvent{}
+	h := NewHandler(context.Background(), 100, 1, []uint16{53}, time.Second*5, 0, true, func(e *types.DnsEvent) {
+		emitted = append(emitted, e)
+	})
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	q := &types.DnsEvent{EventTime: base, SourceIP: "10.0.0.1", SourcePort: 40000, DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: 1, Domain: "example.com.", RecursionDesired: true}
+	if h.Handle(q) != nil {
+		t.Fatal("query should be held in transaction mode")
+	}
+
+	r := &types.DnsEvent{EventTime: base.Add(time.Millisecond * 20), SourceIP: "10.0.0.53", SourcePort: 53, DestinationIP: "10.0.0.1", DestinationPort: 40000, TranscationID: 1, Domain: "example.com.", Response: true, Rcode: "NOERROR"}
+	e := h.Handle(r)
+	if e.TransactionStatus != types.TransactionMatched || !e.QueryTime.Equal(base) || !e.ResponseTime.Equal(r.EventTime) || !e.QueryRecursionDesired || e.DelayMicrosecond != 20000 {
+		t.Fatalf("unexpected transaction record %s", e.JsonString())
+	}
+
+	r2 := *r
+	r2.TranscationID = 2
+	if e := h.Handle(&r2); e.TransactionStatus != types.TransactionResponseOnly {
+		t.Fatalf("expect response only, got %s", e.TransactionStatus)
+	}
+
+	q2 := *q
+	q2.TranscationID = 3
+	h.Handle(&q2)
+	h.Flush()
+	if len(emitted) != 1 || emitted[0].TransactionStatus != types.TransactionQueryOnly || !emitted[0].TimedOut {
+		t.Fatalf("unexpected flushed events %v", emitted)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	emitted := []*types.DnsEvent{}
+	h := NewHandler(context.Background(), 100, 4, []uint16{53}, time.Second*5, 0, false, func(e *types.DnsEvent) {
+		emitted = append(emitted, e)
+	})
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	h.Handle(&types.DnsEvent{EventTime: base, SourceIP: "10.0.0.1", SourcePort: 40000, DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: 1, Domain: "example.com."})
+	// 输入结束时未响应的请求按超时输出
+	h.Flush()
+	if len(emitted) != 1 || !emitted[0].TimedOut || emitted[0].TranscationID != 1 {
+		t.Fatalf("unexpected flushed events %v", emitted)
+	}
+	if s := h.Stats(); s.TimeoutCount != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestQuietShardExpire(t *testing.T) {
+	emitted := make(chan *types.DnsEvent, 10)
+	h := NewHandler(context.Background(), 100, 2, []uint16{53}, time.Second*5, 0, false, func(e *types.DnsEvent) {
+		emitted <- e
+	})
+	defer h.Flush()
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	query := func(client string, t time.Time) *types.DnsEvent {
+		return &types.DnsEvent{EventTime: t, SourceIP: client, SourcePort: 40000, DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: 1, Domain: "example.com."}
+	}
+
+	// 找到落在另一分片的客户端，其后的事件不会触发首个分片的超时检查
+	quiet := query("10.0.0.1", base)
+	var busy *types.DnsEvent
+	for i := 2; busy == nil; i++ {
+		q := query(fmt.Sprintf("10.0.0.%d", i), base.Add(time.Second*10))
+		if FlowHash(q)%2 != FlowHash(quiet)%2 {
+			busy = q
+		}
+	}
+	h.Handle(quiet)
+	h.Handle(busy)
+
+	select {
+	case e := <-emitted:
+		if !e.TimedOut || e.SourceIP != quiet.SourceIP {
+			t.Fatalf("unexpected timeout event %s", e.JsonString())
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("quiet shard query not expired")
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	h := NewHandler(context.Background(), 100, 4, []uint16{53}, time.Second*5, time.Second*5, false, func(e *types.DnsEvent) {})
+	defer h.Flush()
+
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	query := func(port uint16, id uint16, t time.Time) *types.DnsEvent {
+		return &types.DnsEvent{EventTime: t, SourceIP: "10.0.0.1", SourcePort: port, DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: id, Domain: "example.com.", QueryType: "A"}
+	}
+	response := func(q *types.DnsEvent, t time.Time) *types.DnsEvent {
+		return &types.DnsEvent{EventTime: t, SourceIP: q.DestinationIP, SourcePort: 53, DestinationIP: q.SourceIP, DestinationPort: q.SourcePort, TranscationID: q.TranscationID, Domain: q.Domain, QueryType: q.QueryType, Response: true, Rcode: "NOERROR"}
+	}
+
+	q1 := h.Handle(query(40000, 1, base))
+	// 重传请求更换源端口及transaction id，域名大小写不同
+	q2 := query(40002, 2, base.Add(time.Second*2))
+	q2.Domain = "Example.COM."
+	// 重传请求落在其他分片时仍应识别
+	if FlowHash(q1)%4 == FlowHash(q2)%4 {
+		t.Fatal("retransmission expected on another shard")
+	}
+	h.Handle(q2)
+	if q1.Attempt != 1 || q1.Retransmission || q2.Attempt != 2 || !q2.Retransmission {
+		t.Fatalf("unexpected attempts %d %d", q1.Attempt, q2.Attempt)
+	}
+
+	r2 := h.Handle(response(q2, base.Add(time.Second*2+time.Millisecond*10)))
+	if r2.Attempt != 2 || r2.FirstAnswerDelayMicrosecond != 2010000 || r2.DuplicateResponse {
+		t.Fatalf("unexpected first answer %s", r2.JsonString())
+	}
+
+	// 首次请求的迟到响应不再计算首个成功响应时间
+	r1 := h.Handle(response(q1, base.Add(time.Second*3)))
+	if r1.Attempt != 1 || r1.FirstAnswerDelayMicrosecond != 0 {
+		t.Fatalf("unexpected late answer %s", r1.JsonString())
+	}
+
+	if dup := h.Handle(response(q2, base.Add(time.Second*3))); !dup.DuplicateResponse {
+		t.Fatal("expect duplicate response")
+	}
+
+	// 已获得成功响应后的请求重新计数
+	if q3 := h.Handle(query(40003, 3, base.Add(time.Second*4))); q3.Attempt != 1 {
+		t.Fatalf("expect new attempt, got %d", q3.Attempt)
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	q := &types.DnsEvent{SourceIP: "10.0.0.1", SourcePort: 40000, DestinationIP: "10.0.0.53", DestinationPort: 53}
+	r := &types.DnsEvent{SourceIP: "10.0.0.53", SourcePort: 53, DestinationIP: "10.0.0.1", DestinationPort: 40000, Response: true}
+	if FlowHash(q) != FlowHash(r) {
+		t.Fatal("query and response of one flow should have the same hash")
+	}
+
+	// 同一地址（如递归服务器）的请求按端口及transaction id分散至各分片
+	shards := map[uint32]bool{}
+	for i := 0; i < 100; i++ {
+		e := &types.DnsEvent{SourceIP: "10.0.0.1", SourcePort: uint16(40000 + i), DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: uint16(i)}
+		shards[FlowHash(e)%4] = true
+	}
+	if len(shards) != 4 {
+		t.Fatalf("queries of one client should spread over shards, got %d", len(shards))
+	}
+}
+
+func benchmarkEvents(n int) []*types.DnsEvent {
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	events := make([]*types.DnsEvent, 0, n*2)
+	for i := 0; i < n; i++ {
+		client := fmt.Sprintf("10.0.%d.%d", i/250%250, i%250)
+		t := base.Add(time.Duration(i) * time.Microsecond)
+		events = append(events,
+			&types.DnsEvent{EventTime: t, SourceIP: client, SourcePort: uint16(10000 + i%50000), DestinationIP: "10.0.0.53", DestinationPort: 53, TranscationID: uint16(i), Domain: "example.com.", QueryType: "A"},
+			&types.DnsEvent{EventTime: t.Add(time.Millisecond), SourceIP: "10.0.0.53", SourcePort: 53, DestinationIP: client, DestinationPort: uint16(10000 + i%50000), TranscationID: uint16(i), Domain: "example.com.", QueryType: "A", Response: true})
+	}
+	return events
+}
+
+// benchmarkDispatch 每个事件经会话匹配后序列化为JSON，模拟后续插件及结果输出的开销
+func benchmarkDispatch(b *testing.B, workerCount int) {
+	events := benchmarkEvents(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := NewHandler(context.Background(), 100000, workerCount, []uint16{53}, time.Second*5, 0, false, func(e *types.DnsEvent) {})
+		d := NewDispatcher(workerCount, 1024, func(e *types.DnsEvent) {
+			if e = h.Handle(e); e != nil {
+				e.JsonString()
+			}
+		})
+		for _, e := range events {
+			d.Dispatch(e)
+		}
+		d.Close()
+		h.Flush()
+	}
+	b.ReportMetric(float64(len(events)*b.N)/b.Elapsed().Seconds(), "events/s")
+}
+
+func BenchmarkDispatchSingleWorker(b *testing.B) {
+	benchmarkDispatch(b, 1)
+}
+
+func BenchmarkDispatchSharded(b *testing.B) {
+	benchmarkDispatch(b, runtime.NumCPU())
+}
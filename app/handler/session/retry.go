@@ -0,0 +1,108 @@
+package session
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+// RetryKey 重传识别不区分源端口及transaction id，域名忽略大小写
+type RetryKey struct {
+	ClientIP  string
+	Domain    string
+	QueryType string
+}
+
+// retryState 同一RetryKey下尚未获得成功响应的请求尝试
+type retryState struct {
+	FirstQueryTime time.Time
+	LastQueryTime  time.Time
+	Attempts       uint32
+	Answered       bool
+}
+
+// retryTracker 记录客户端的请求尝试及已响应的会话，重传请求更换源端口或transaction id后落在其他分片，
+// 因此由全部分片共用并单独加锁，容量与会话表一致
+type retryTracker struct {
+	mu       sync.Mutex
+	window   time.Duration
+	attempts *lru.Cache
+	answered *lru.Cache
+}
+
+func newRetryTracker(size int, window time.Duration) *retryTracker {
+	attempts, _ := lru.New(size)
+	answered, _ := lru.New(size)
+	return &retryTracker{
+		window:   window,
+		attempts: attempts,
+		answered: answered,
+	}
+}
+
+func newRetryKey(clientIP string, e *types.DnsEvent) RetryKey {
+	return RetryKey{
+		ClientIP:  clientIP,
+		Domain:    strings.ToLower(e.Domain),
+		QueryType: e.QueryType,
+	}
+}
+
+// query 返回请求的尝试次数，距上次未响应的尝试不超过window时视为重传
+func (t *retryTracker) query(e *types.DnsEvent) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := newRetryKey(e.SourceIP, e)
+	if v, ok := t.attempts.Peek(k); ok {
+		st := v.(*retryState)
+		if !st.Answered && e.EventTime.Sub(st.LastQueryTime) <= t.window {
+			st.LastQueryTime = e.EventTime
+			st.Attempts += 1
+			return st.Attempts
+		}
+	}
+
+	t.attempts.Add(k, &retryState{
+		FirstQueryTime: e.EventTime,
+		LastQueryTime:  e.EventTime,
+		Attempts:       1,
+	})
+	return 1
+}
+
+// answer 记录已匹配的响应，返回首次请求至首个成功响应的时间，非首个成功响应时返回false
+func (t *retryTracker) answer(k SessionKey, e *types.DnsEvent) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.answered.Add(k, e.EventTime)
+
+	if e.Rcode != dns.RcodeToString[dns.RcodeSuccess] {
+		return 0, false
+	}
+	v, ok := t.attempts.Peek(newRetryKey(e.DestinationIP, e))
+	if !ok {
+		return 0, false
+	}
+	st := v.(*retryState)
+	if st.Answered {
+		return 0, false
+	}
+	st.Answered = true
+	return e.EventTime.Sub(st.FirstQueryTime), true
+}
+
+// duplicate 未匹配到请求的响应，其会话在window内已被响应过时视为重复响应
+func (t *retryTracker) duplicate(k SessionKey, e *types.DnsEvent) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.answered.Peek(k)
+	if !ok {
+		return false
+	}
+	return e.EventTime.Sub(v.(time.Time)) <= t.window
+}
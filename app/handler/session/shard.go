@@ -0,0 +1,70 @@
+package session
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/hiwyw/dnscap-tool/app/types"
+)
+
+// FlowHash 按客户端地址、端口及transaction id计算会话流哈希，请求与响应按方向归一，
+// 同一递归服务器等单一地址的大量请求仍可分散至各分片；重传识别不依赖分片，见retryTracker
+func FlowHash(e *types.DnsEvent) uint32 {
+	clientIP, clientPort := e.SourceIP, e.SourcePort
+	if e.Response {
+		clientIP, clientPort = e.DestinationIP, e.DestinationPort
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(clientIP))
+	h.Write([]byte{byte(clientPort >> 8), byte(clientPort), byte(e.TranscationID >> 8), byte(e.TranscationID)})
+	// fnv低位分布较差，端口与transaction id同步递增时取模结果相同，折叠高位后再取模
+	sum := h.Sum32()
+	return sum ^ sum>>16
+}
+
+// shard 会话表分片，同一分片内的请求按缓存时间先后淘汰
+type shard struct {
+	mu    sync.Mutex
+	cache *SessionCache
+}
+
+// NewDispatcher 按FlowHash将事件分发至workerCount个有序worker，
+// 同一事务的请求与响应始终由同一worker按到达顺序处理，不同流之间并行
+func NewDispatcher(workerCount int, queueSize int, handle func(*types.DnsEvent)) *Dispatcher {
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	d := &Dispatcher{
+		chs: make([]chan *types.DnsEvent, workerCount),
+	}
+	for i := range d.chs {
+		ch := make(chan *types.DnsEvent, queueSize)
+		d.chs[i] = ch
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for e := range ch {
+				handle(e)
+			}
+		}()
+	}
+	return d
+}
+
+type Dispatcher struct {
+	chs []chan *types.DnsEvent
+	wg  sync.WaitGroup
+}
+
+func (d *Dispatcher) Dispatch(e *types.DnsEvent) {
+	d.chs[FlowHash(e)%uint32(len(d.chs))] <- e
+}
+
+// Close 等待已分发的事件全部处理完成后返回，调用后不可再分发
+func (d *Dispatcher) Close() {
+	for _, ch := range d.chs {
+		close(ch)
+	}
+	d.wg.Wait()
+}
@@ -6,10 +6,11 @@ import (
 	"github.com/hiwyw/dnscap-tool/app/types"
 )
 
-func NewHandler(ctx context.Context, selfIps []string) *Handler {
+func NewHandler(ctx context.Context, selfIps []string, dnsPorts []uint16) *Handler {
 	h := &Handler{
-		ctx:     ctx,
-		selfIps: map[string]struct{}{},
+		ctx:      ctx,
+		selfIps:  map[string]struct{}{},
+		dnsPorts: types.NewPortSet(dnsPorts),
 	}
 
 	for _, i := range selfIps {
@@ -20,27 +21,33 @@ func NewHandler(ctx context.Context, selfIps []string) *Handler {
 }
 
 type Handler struct {
-	ctx     context.Context
-	selfIps map[string]struct{}
+	ctx      context.Context
+	selfIps  map[string]struct{}
+	dnsPorts types.PortSet
 }
 
 func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
+	// dnstap等输入源已直接给出流量方向
+	if e.TrafficDirection != "" {
+		return e
+	}
+
 	var direction string
 	_, ok := h.selfIps[e.SourceIP]
 	if ok {
-		if e.DestinationPort == 53 {
+		if h.dnsPorts.Contains(e.DestinationPort) {
 			direction = RecursionQueryDirection
 		}
-		if e.SourcePort == 53 {
+		if h.dnsPorts.Contains(e.SourcePort) {
 			direction = ClientResponseDirection
 		}
 	}
 
 	if !ok {
-		if e.DestinationPort == 53 {
+		if h.dnsPorts.Contains(e.DestinationPort) {
 			direction = ClientQueryDirection
 		}
-		if e.SourcePort == 53 {
+		if h.dnsPorts.Contains(e.SourcePort) {
 			direction = RecursionResponseDirection
 		}
 	}
@@ -52,8 +59,8 @@ func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
 }
 
 const (
-	ClientQueryDirection       = "client_query"
-	ClientResponseDirection    = "client_response"
-	RecursionQueryDirection    = "recursion_query"
-	RecursionResponseDirection = "recursion_response"
+	ClientQueryDirection       = types.ClientQueryDirection
+	ClientResponseDirection    = types.ClientResponseDirection
+	RecursionQueryDirection    = types.RecursionQueryDirection
+	RecursionResponseDirection = types.RecursionResponseDirection
 )
@@ -38,7 +38,7 @@ type Handler struct {
 }
 
 func (h *Handler) Handle(e *types.DnsEvent) *types.DnsEvent {
-	name, err := g53.NameFromString(e.Domain)
+	name, err := g53.NameFromString(e.NormalizedDomain)
 	if err != nil {
 		return e
 	}
@@ -1,6 +1,9 @@
 package logger
 
 import (
+	"os"
+	"testing"
+
 	"github.com/natefinch/lumberjack"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -38,6 +41,10 @@ func init() {
 	level = atomicLevel
 
 	var writes = []zapcore.WriteSyncer{zapcore.AddSync(&hook)}
+	// 单元测试输出至stderr，避免在包目录下生成日志文件
+	if testing.Testing() {
+		writes = []zapcore.WriteSyncer{zapcore.Lock(os.Stderr)}
+	}
 	core := zapcore.NewCore(
 		zapcore.NewConsoleEncoder(encoderConfig),
 		zapcore.NewMultiWriteSyncer(writes...),
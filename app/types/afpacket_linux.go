@@ -0,0 +1,214 @@
+//go:build linux
+
+package types
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+)
+
+const (
+	afpacketDefaultRingSizeMB  = 64
+	afpacketDefaultBlockSizeKB = 1024
+	afpacketPollTimeout        = time.Millisecond * 100
+	// afpacketCopyChunkSize 帧数据拷贝所用内存块的大小，多个帧共享同一内存块以减少分配，仍被引用的帧会使整个内存块无法回收
+	afpacketCopyChunkSize = 256 * 1024
+)
+
+var afpacketFanoutTypes = map[string]afpacket.FanoutType{
+	"hash":   afpacket.FanoutHash,
+	"lb":     afpacket.FanoutLoadBalance,
+	"cpu":    afpacket.FanoutCPU,
+	"random": afpacket.FanoutRandom,
+}
+
+// afpacketRing 同一网卡上的一组TPACKET_V3读取器，多个读取器通过fanout分担流量
+type afpacketRing struct {
+	handles []*afpacket.TPacket
+}
+
+func newAfpacketRing(device, bpfFilter string, opts CaptureOptions) (*afpacketRing, error) {
+	ringSizeMB := opts.RingSizeMB
+	if ringSizeMB <= 0 {
+		ringSizeMB = afpacketDefaultRingSizeMB
+	}
+	blockSizeKB := opts.BlockSizeKB
+	if blockSizeKB <= 0 {
+		blockSizeKB = afpacketDefaultBlockSizeKB
+	}
+	readers := opts.FanoutReaders
+	if readers <= 0 {
+		readers = 1
+	}
+	if readers > 1 && opts.FanoutGroup == 0 {
+		return nil, fmt.Errorf("fanout group must be set when fanout readers %d > 1", readers)
+	}
+
+	blockSize := blockSizeKB * 1024
+	numBlocks := ringSizeMB * 1024 / blockSizeKB
+	// 设置帧大小不小于snaplen，且能被块大小整除
+	frameSize := afpacket.DefaultFrameSize
+	for frameSize < opts.SnapLen && frameSize < blockSize {
+		frameSize *= 2
+	}
+
+	// any 表示绑定所有网卡
+	iface := device
+	if iface == "any" {
+		iface = ""
+	}
+
+	var filter []bpf.RawInstruction
+	if bpfFilter != "" {
+		insts, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, opts.SnapLen, bpfFilter)
+		if err != nil {
+			return nil, fmt.Errorf("compile bpf filter failed [%s] %s", bpfFilter, err)
+		}
+		for _, i := range insts {
+			filter = append(filter, bpf.RawInstruction{Op: i.Code, Jt: i.Jt, Jf: i.Jf, K: i.K})
+		}
+	}
+
+	r := &afpacketRing{}
+	for i := 0; i < readers; i++ {
+		h, err := afpacket.NewTPacket(
+			afpacket.OptInterface(iface),
+			afpacket.OptFrameSize(frameSize),
+			afpacket.OptBlockSize(blockSize),
+			afpacket.OptNumBlocks(numBlocks),
+			afpacket.OptPollTimeout(afpacketPollTimeout),
+			afpacket.TPacketVersion3)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("open afpacket device %s failed %s", device, err)
+		}
+		r.handles = append(r.handles, h)
+
+		if filter != nil {
+			if err := h.SetBPF(filter); err != nil {
+				r.close()
+				return nil, fmt.Errorf("set bpf filter failed [%s] %s", bpfFilter, err)
+			}
+		}
+
+		if opts.FanoutGroup != 0 {
+			t, ok := afpacketFanoutTypes[opts.FanoutType]
+			if !ok {
+				t = afpacket.FanoutHash
+			}
+			if err := h.SetFanout(t, opts.FanoutGroup); err != nil {
+				r.close()
+				return nil, fmt.Errorf("set fanout group %d failed %s", opts.FanoutGroup, err)
+			}
+		}
+	}
+
+	logger.Infof("open afpacket device %s succeed, readers %d, block size %d, block count %d, fanout group %d",
+		device, readers, blockSize, numBlocks, opts.FanoutGroup)
+	return r, nil
+}
+
+// stats 返回内核统计的接收、丢弃及队列冻结计数，各读取器累加
+func (r *afpacketRing) stats() (packets, drops, freezes uint64) {
+	stats := make([]tpacketStatsV3, 0, len(r.handles))
+	for _, h := range r.handles {
+		_, s, err := h.SocketStats()
+		if err != nil {
+			logger.Debugf("get afpacket socket stats failed %s", err)
+			continue
+		}
+		stats = append(stats, &s)
+	}
+	return sumTpacketStats(stats)
+}
+
+// tpacketStatsV3 TPACKET_V3的内核统计，由afpacket.SocketStatsV3实现，均为打开以来的累计值，packets已包含drops
+type tpacketStatsV3 interface {
+	Packets() uint
+	Drops() uint
+	QueueFreezes() uint
+}
+
+func sumTpacketStats(stats []tpacketStatsV3) (packets, drops, freezes uint64) {
+	for _, s := range stats {
+		packets += uint64(s.Packets())
+		drops += uint64(s.Drops())
+		freezes += uint64(s.QueueFreezes())
+	}
+	return
+}
+
+func (r *afpacketRing) close() {
+	for _, h := range r.handles {
+		h.Close()
+	}
+}
+
+func (s *PcapEventSource) handleAfpacket(d CaptureDevice) {
+	ring, err := newAfpacketRing(d.Name, d.BpfFilter, s.captureOpts)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	// Close会释放环形缓冲区，而PacketSource的读取协程无法中止，故不主动关闭，随进程退出释放
+	s.ringMu.Lock()
+	s.rings = append(s.rings, ring)
+	s.ringMu.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, h := range ring.handles {
+		wg.Add(1)
+		go func(h *afpacket.TPacket) {
+			defer wg.Done()
+			ps := gopacket.NewPacketSource(&afpacketSource{reader: h}, layers.LinkTypeEthernet)
+			// 数据已拷贝且不会被改写，无需再次拷贝；各层按需在worker中解码，读取协程只解析到网络层用于分发
+			ps.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+			s.handlePackets(ps, layers.LinkTypeEthernet, d.Name)
+		}(h)
+	}
+	wg.Wait()
+}
+
+type zeroCopyReader interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// afpacketSource 零拷贝读取环形缓冲区中的帧，帧在下次读取后即被内核复用，而解码在worker中异步进行，
+// 故将帧数据依次拷贝至共享的内存块，代替逐包分配
+type afpacketSource struct {
+	reader zeroCopyReader
+	chunk  []byte
+}
+
+func (a *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := a.reader.ZeroCopyReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+	if len(data) > len(a.chunk) {
+		a.chunk = make([]byte, max(afpacketCopyChunkSize, len(data)))
+	}
+	n := copy(a.chunk, data)
+	data = a.chunk[:n:n]
+	a.chunk = a.chunk[n:]
+	return data, ci, nil
+}
+
+// ancillaryVlanID 内核会剥离最外层VLAN标签，通过辅助数据返回
+func ancillaryVlanID(md *gopacket.PacketMetadata) (uint16, bool) {
+	for _, d := range md.AncillaryData {
+		if v, ok := d.(afpacket.AncillaryVLAN); ok {
+			return uint16(v.VLAN), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package types
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+type fakeTpacketStats struct {
+	packets, drops, freezes uint
+}
+
+func (s fakeTpacketStats) Packets() uint      { return s.packets }
+func (s fakeTpacketStats) Drops() uint        { return s.drops }
+func (s fakeTpacketStats) QueueFreezes() uint { return s.freezes }
+
+func TestSumTpacketStats(t *testing.T) {
+	// fanout的各读取器分别统计，内核返回的packets已包含drops
+	packets, drops, freezes := sumTpacketStats([]tpacketStatsV3{
+		fakeTpacketStats{packets: 1000, drops: 10, freezes: 1},
+		fakeTpacketStats{packets: 500, drops: 0, freezes: 0},
+	})
+	if packets != 1500 || drops != 10 || freezes != 1 {
+		t.Fatalf("unexpected stats packets %d drops %d freezes %d", packets, drops, freezes)
+	}
+	if packets, drops, freezes := sumTpacketStats(nil); packets != 0 || drops != 0 || freezes != 0 {
+		t.Fatal("expect zero stats without readers")
+	}
+}
+
+// fakeZeroCopyReader 与环形缓冲区相同，每次读取复用同一块内存
+type fakeZeroCopyReader struct {
+	frames [][]byte
+	buf    []byte
+}
+
+func (r *fakeZeroCopyReader) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	f := r.frames[0]
+	r.frames = r.frames[1:]
+	n := copy(r.buf, f)
+	return r.buf[:n], gopacket.CaptureInfo{CaptureLength: n, Length: n}, nil
+}
+
+func TestAfpacketSourceCopy(t *testing.T) {
+	frames := [][]byte{
+		bytes.Repeat([]byte{1}, 100),
+		bytes.Repeat([]byte{2}, 60),
+		bytes.Repeat([]byte{3}, afpacketCopyChunkSize+1),
+		bytes.Repeat([]byte{4}, 10),
+	}
+	s := &afpacketSource{reader: &fakeZeroCopyReader{frames: append([][]byte(nil), frames...), buf: make([]byte, afpacketCopyChunkSize*2)}}
+
+	read := [][]byte{}
+	for range frames {
+		data, _, err := s.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, data)
+	}
+	// 后续读取不能改写已返回的帧数据
+	for i, f := range frames {
+		if !bytes.Equal(read[i], f) || cap(read[i]) != len(f) {
+			t.Fatalf("frame %d changed after later reads", i)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package types
+
+import (
+	"github.com/google/gopacket"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+)
+
+type afpacketRing struct{}
+
+func (r *afpacketRing) stats() (packets, drops, freezes uint64) {
+	return
+}
+
+func (s *PcapEventSource) handleAfpacket(d CaptureDevice) {
+	logger.Fatalf("afpacket capture mode only supported on linux")
+}
+
+func ancillaryVlanID(md *gopacket.PacketMetadata) (uint16, bool) {
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package types
+
+import "time"
+
+// FileOptions 离线文件输入选项
+type FileOptions struct {
+	// ReplaySpeed 大于0时按数据包捕获时间的倍速回放，为0时不限速
+	ReplaySpeed float64
+	StartTime   time.Time
+	EndTime     time.Time
+	SkipPackets uint64
+	MaxPackets  uint64
+}
+
+// packetBounds 按时间窗口及包数截取数据包，skip及max仅统计时间窗口内的数据包
+type packetBounds struct {
+	start   time.Time
+	end     time.Time
+	skip    uint64
+	max     uint64
+	seen    uint64
+	handled uint64
+	done    bool
+}
+
+func newPacketBounds(opts FileOptions) *packetBounds {
+	if opts.StartTime.IsZero() && opts.EndTime.IsZero() && opts.SkipPackets == 0 && opts.MaxPackets == 0 {
+		return nil
+	}
+	return &packetBounds{
+		start: opts.StartTime,
+		end:   opts.EndTime,
+		skip:  opts.SkipPackets,
+		max:   opts.MaxPackets,
+	}
+}
+
+// accept 返回数据包是否需要处理，越过end_time或达到max_packets后done置为true，后续数据包均不再处理
+func (b *packetBounds) accept(t time.Time) bool {
+	if b == nil {
+		return true
+	}
+	if b.done {
+		return false
+	}
+	if !b.end.IsZero() && t.After(b.end) {
+		b.done = true
+		return false
+	}
+	if !b.start.IsZero() && t.Before(b.start) {
+		return false
+	}
+
+	b.seen++
+	if b.seen <= b.skip {
+		return false
+	}
+	if b.max > 0 && b.handled >= b.max {
+		b.done = true
+		return false
+	}
+	b.handled++
+	return true
+}
+
+func (b *packetBounds) finished() bool {
+	return b != nil && b.done
+}
@@ -0,0 +1,34 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacketBounds(t *testing.T) {
+	base := time.Date(2024, 6, 19, 17, 0, 0, 0, time.UTC)
+	b := newPacketBounds(FileOptions{
+		StartTime:   base.Add(time.Minute),
+		EndTime:     base.Add(time.Minute * 10),
+		SkipPackets: 1,
+		MaxPackets:  2,
+	})
+
+	var accepted []int
+	for i := 0; i < 12; i++ {
+		if b.accept(base.Add(time.Minute * time.Duration(i))) {
+			accepted = append(accepted, i)
+		}
+		if b.finished() {
+			break
+		}
+	}
+	// 第0分钟早于窗口，第1分钟被跳过，处理2个后停止
+	if len(accepted) != 2 || accepted[0] != 2 || accepted[1] != 3 || !b.finished() {
+		t.Fatalf("unexpected accepted %v finished %v", accepted, b.finished())
+	}
+
+	if newPacketBounds(FileOptions{ReplaySpeed: 1}) != nil {
+		t.Fatal("expect nil bounds without limits")
+	}
+}
@@ -0,0 +1,253 @@
+package types
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defragTimeout       = time.Second * 30
+	defragSweepInterval = time.Second
+	defragMaxDatagrams  = 4096
+	// defragMaxOrphans 未收到首个分片的数据报上限，首个分片被过滤的非DNS流量的后续分片永远无法重组
+	defragMaxOrphans   = 256
+	defragMaxSize      = 65535
+	defragMaxFragments = 64
+)
+
+type fragKey struct {
+	src   [16]byte
+	dst   [16]byte
+	id    uint32
+	proto layers.IPProtocol
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type fragList struct {
+	frags []fragment
+	total int
+	// received 已收到分片的最大结尾
+	received  int
+	firstSeen time.Time
+	// orphan 尚未收到首个分片，elem为其在对应淘汰队列中的位置
+	orphan bool
+	elem   *list.Element
+}
+
+// defragmenter 重组IPv4/IPv6分片，按数据包时间淘汰超时分片，在途数据报数量有上限；
+// 未收到首个分片的数据报单独排队且数量受限，淘汰时优先丢弃，避免挤占可重组的数据报
+type defragmenter struct {
+	mu sync.Mutex
+	// lists 在途数据报，orphans按首次出现的先后排列未收到首个分片的数据报，started按收到首个分片的先后排列其余数据报
+	lists       map[fragKey]*fragList
+	started     *list.List
+	orphans     *list.List
+	lastSweep   time.Time
+	reassembled atomic.Uint64
+	expired     atomic.Uint64
+	orphaned    atomic.Uint64
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{
+		lists:   map[fragKey]*fragList{},
+		started: list.New(),
+		orphans: list.New(),
+	}
+}
+
+// reassemble 非分片包原样返回，分片未收齐时返回false，收齐后返回以传输层开始解码的新数据包
+func (d *defragmenter) reassemble(p gopacket.Packet, t time.Time) (gopacket.Packet, bool, error) {
+	var k fragKey
+	var f fragment
+	var more bool
+
+	// 隧道封装时取最外层的分片，重组后的数据包再交由调用方继续检查内层
+	found := false
+	var lastIPv6 *layers.IPv6
+	for _, l := range p.Layers() {
+		switch ip := l.(type) {
+		case *layers.IPv4:
+			if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+				continue
+			}
+			copy(k.src[:], ip.SrcIP.To16())
+			copy(k.dst[:], ip.DstIP.To16())
+			k.id = uint32(ip.Id)
+			k.proto = ip.Protocol
+			f.offset = int(ip.FragOffset) * 8
+			f.data = ip.Payload
+			more = ip.Flags&layers.IPv4MoreFragments != 0
+			found = true
+		case *layers.IPv6:
+			lastIPv6 = ip
+		case *layers.IPv6Fragment:
+			if lastIPv6 == nil {
+				return nil, false, decodeErrorf(ErrReasonFragment, "packet ipv6 fragment missing ipv6 layer")
+			}
+			copy(k.src[:], lastIPv6.SrcIP.To16())
+			copy(k.dst[:], lastIPv6.DstIP.To16())
+			k.id = ip.Identification
+			k.proto = ip.NextHeader
+			f.offset = int(ip.FragmentOffset) * 8
+			f.data = ip.Payload
+			more = ip.MoreFragments
+			found = true
+		}
+		if found {
+			break
+		}
+	}
+	if !found {
+		return p, true, nil
+	}
+
+	if f.offset+len(f.data) > defragMaxSize {
+		return nil, false, decodeErrorf(ErrReasonFragment, "packet fragment exceeds max datagram size %d", defragMaxSize)
+	}
+	// 分片数据所在的底层数组会被数据包复用，需拷贝
+	f.data = append([]byte(nil), f.data...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sweepIfNeed(t)
+
+	l, ok := d.lists[k]
+	if !ok {
+		l = &fragList{firstSeen: t, orphan: f.offset != 0}
+		if l.orphan && d.orphans.Len() >= defragMaxOrphans {
+			d.drop(d.orphans.Front().Value.(fragKey))
+		}
+		if len(d.lists) >= defragMaxDatagrams {
+			d.evictOldest()
+		}
+		if l.orphan {
+			l.elem = d.orphans.PushBack(k)
+		} else {
+			l.elem = d.started.PushBack(k)
+		}
+		d.lists[k] = l
+	} else if l.orphan && f.offset == 0 {
+		d.orphans.Remove(l.elem)
+		l.orphan = false
+		l.elem = d.started.PushBack(k)
+	}
+
+	if len(l.frags) >= defragMaxFragments {
+		d.drop(k)
+		return nil, false, decodeErrorf(ErrReasonFragment, "packet fragments exceed max count %d", defragMaxFragments)
+	}
+
+	end := f.offset + len(f.data)
+	if !more {
+		// 最后分片重复时长度须一致，且已收到的分片不能超出其结尾
+		if (l.total != 0 && l.total != end) || l.received > end {
+			d.drop(k)
+			return nil, false, decodeErrorf(ErrReasonFragment, "packet last fragment end %d conflicts with received data", end)
+		}
+		l.total = end
+	}
+	if l.total != 0 && (f.offset >= l.total || end > l.total) {
+		d.drop(k)
+		return nil, false, decodeErrorf(ErrReasonFragment, "packet fragment %d-%d beyond datagram end %d", f.offset, end, l.total)
+	}
+	l.frags = append(l.frags, f)
+	l.received = max(l.received, end)
+
+	payload, ok := l.build()
+	if !ok {
+		return nil, false, nil
+	}
+	d.remove(k, l)
+	d.reassembled.Add(1)
+
+	return gopacket.NewPacket(payload, k.proto.LayerType(), gopacket.Default), true, nil
+}
+
+// sweepIfNeed 两个队列大致按时间先后排列，只从队首清理，清理代价与超时的数据报数成正比
+func (d *defragmenter) sweepIfNeed(t time.Time) {
+	if t.Sub(d.lastSweep) < defragSweepInterval {
+		return
+	}
+	d.lastSweep = t
+
+	for _, q := range []*list.List{d.orphans, d.started} {
+		for q.Len() > 0 {
+			k := q.Front().Value.(fragKey)
+			if t.Sub(d.lists[k].firstSeen) <= defragTimeout {
+				break
+			}
+			d.drop(k)
+		}
+	}
+}
+
+// evictOldest 优先淘汰最早的未收到首个分片的数据报
+func (d *defragmenter) evictOldest() {
+	q := d.orphans
+	if q.Len() == 0 {
+		q = d.started
+	}
+	if q.Len() > 0 {
+		d.drop(q.Front().Value.(fragKey))
+	}
+}
+
+// drop 丢弃未重组的数据报，未收到首个分片的单独计数
+func (d *defragmenter) drop(k fragKey) {
+	l := d.lists[k]
+	d.remove(k, l)
+	if l.orphan {
+		d.orphaned.Add(1)
+	} else {
+		d.expired.Add(1)
+	}
+}
+
+func (d *defragmenter) remove(k fragKey, l *fragList) {
+	if l.orphan {
+		d.orphans.Remove(l.elem)
+	} else {
+		d.started.Remove(l.elem)
+	}
+	delete(d.lists, k)
+}
+
+// build 最后一个分片已到达且分片覆盖[0, total)时拼接出完整负载
+func (l *fragList) build() ([]byte, bool) {
+	if l.total == 0 {
+		return nil, false
+	}
+
+	sort.Slice(l.frags, func(i, j int) bool {
+		return l.frags[i].offset < l.frags[j].offset
+	})
+
+	covered := 0
+	for _, f := range l.frags {
+		if f.offset > covered {
+			return nil, false
+		}
+		covered = max(covered, f.offset+len(f.data))
+	}
+	if covered < l.total {
+		return nil, false
+	}
+
+	payload := make([]byte, l.total)
+	for _, f := range l.frags {
+		copy(payload[f.offset:], f.data)
+	}
+	return payload, true
+}
@@ -0,0 +1,174 @@
+package types
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+func TestDefragIPv4(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeTXT)
+	m.Response = true
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"0123456789012345678901234567890123456789012345678901234567890123456789"},
+		})
+	}
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 53), DstIP: net.IPv4(10, 0, 0, 1)}
+	udp := &layers.UDP{SrcPort: 53, DstPort: 40000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	datagram := buf.Bytes()
+
+	fragmentPacket := func(offset int, data []byte, more bool) gopacket.Packet {
+		frag := *ip
+		frag.Id = 1234
+		frag.FragOffset = uint16(offset / 8)
+		if more {
+			frag.Flags = layers.IPv4MoreFragments
+		}
+		b := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(b, gopacket.SerializeOptions{FixLengths: true}, &frag, gopacket.Payload(data)); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+
+	d := newDefragmenter()
+	now := time.Now()
+
+	// 乱序到达
+	if _, complete, err := d.reassemble(fragmentPacket(1000, datagram[1000:], false), now); err != nil || complete {
+		t.Fatalf("expect incomplete, got complete %v err %v", complete, err)
+	}
+	p, complete, err := d.reassemble(fragmentPacket(0, datagram[:1000], true), now)
+	if err != nil || !complete {
+		t.Fatalf("expect complete, got complete %v err %v", complete, err)
+	}
+
+	udpLayer := p.Layer(layers.LayerTypeUDP)
+	if udpLayer == nil {
+		t.Fatal("reassembled packet missing udp layer")
+	}
+	e := &DnsEvent{}
+	if err := e.unpackMsg(udpLayer.(*layers.UDP).Payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Answer) != 20 || d.reassembled.Load() != 1 || len(d.lists) != 0 {
+		t.Fatalf("unexpected answer count %d reassembled %d pending %d", len(e.Answer), d.reassembled.Load(), len(d.lists))
+	}
+
+	// 超时淘汰
+	d.reassemble(fragmentPacket(0, datagram[:1000], true), now)
+	d.reassemble(fragmentPacket(0, datagram[:1000], true), now.Add(defragTimeout*2))
+	if d.expired.Load() != 1 {
+		t.Fatalf("expect 1 expired, got %d", d.expired.Load())
+	}
+}
+
+func TestDefragOverlapBeyondEnd(t *testing.T) {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 53), DstIP: net.IPv4(10, 0, 0, 1), Id: 1234}
+	fragmentPacket := func(offset int, size int, more bool) gopacket.Packet {
+		frag := *ip
+		frag.FragOffset = uint16(offset / 8)
+		if more {
+			frag.Flags = layers.IPv4MoreFragments
+		}
+		b := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(b, gopacket.SerializeOptions{FixLengths: true}, &frag, gopacket.Payload(make([]byte, size))); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+
+	cases := map[string][]gopacket.Packet{
+		// 最后分片的结尾早于已收到的数据
+		"last fragment before received data": {
+			fragmentPacket(0, 8, true),
+			fragmentPacket(8, 32, true),
+			fragmentPacket(32, 8, true),
+			fragmentPacket(16, 8, false),
+		},
+		// 最后分片到达后收到超出结尾的分片
+		"fragment after end": {
+			fragmentPacket(16, 8, false),
+			fragmentPacket(0, 8, true),
+			fragmentPacket(32, 8, true),
+		},
+		"conflicting last fragments": {
+			fragmentPacket(16, 8, false),
+			fragmentPacket(8, 8, false),
+		},
+	}
+	for name, packets := range cases {
+		t.Run(name, func(t *testing.T) {
+			d := newDefragmenter()
+			var err error
+			for _, p := range packets {
+				if _, _, err = d.reassemble(p, time.Now()); err != nil {
+					break
+				}
+			}
+			if errReason(err) != ErrReasonFragment {
+				t.Fatalf("expect fragment error, got %v", err)
+			}
+			if len(d.lists) != 0 || d.expired.Load()+d.orphaned.Load() != 1 {
+				t.Fatalf("expect datagram dropped, pending %d expired %d orphaned %d", len(d.lists), d.expired.Load(), d.orphaned.Load())
+			}
+		})
+	}
+}
+
+func TestDefragOrphanLimit(t *testing.T) {
+	fragmentPacket := func(id uint16, offset int, size int, more bool) gopacket.Packet {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 53), DstIP: net.IPv4(10, 0, 0, 1), Id: id, FragOffset: uint16(offset / 8)}
+		if more {
+			ip.Flags = layers.IPv4MoreFragments
+		}
+		b := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(b, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(make([]byte, size))); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(b.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+
+	d := newDefragmenter()
+	now := time.Now()
+	d.reassemble(fragmentPacket(0, 0, 8, true), now)
+
+	// 首个分片被过滤的数据报只占用有限的缓存，不淘汰已收到首个分片的数据报
+	for i := 1; i <= defragMaxOrphans*2; i++ {
+		d.reassemble(fragmentPacket(uint16(i), 8, 8, false), now)
+	}
+	if d.orphans.Len() != defragMaxOrphans || d.orphaned.Load() != defragMaxOrphans || d.expired.Load() != 0 {
+		t.Fatalf("unexpected orphans %d orphaned %d expired %d", d.orphans.Len(), d.orphaned.Load(), d.expired.Load())
+	}
+	if _, complete, err := d.reassemble(fragmentPacket(0, 8, 8, false), now); err != nil || !complete {
+		t.Fatalf("expect complete, got complete %v err %v", complete, err)
+	}
+
+	// 后到达的首个分片使数据报不再计为孤立分片
+	if _, complete, _ := d.reassemble(fragmentPacket(defragMaxOrphans*2, 0, 8, true), now); !complete {
+		t.Fatal("expect orphan completed by first fragment")
+	}
+
+	// 超时清理
+	d.reassemble(fragmentPacket(0, 0, 8, true), now.Add(defragTimeout*2))
+	if len(d.lists) != 1 || d.orphans.Len() != 0 || d.orphaned.Load() != defragMaxOrphans*2-1 {
+		t.Fatalf("unexpected pending %d orphans %d orphaned %d", len(d.lists), d.orphans.Len(), d.orphaned.Load())
+	}
+}
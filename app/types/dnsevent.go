@@ -1,7 +1,8 @@
 package types
 
 import (
-	"encoding/json"
+	"encoding/binary"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -10,75 +11,244 @@ import (
 )
 
 type DnsEvent struct {
+	// 结构版本，由各输出格式写入时填充为SchemaVersion
+	SchemaVersion uint32 `json:"SchemaVersion" pb:"1"`
+
 	// 常规属性
-	EventTime            time.Time `json:"EventTime"`
-	SourceIP             string    `json:"SourceIP"`
-	SourcePort           uint16    `json:"SourcePort"`
-	DestinationIP        string    `json:"DestinationIP"`
-	DestinationPort      uint16    `json:"DestinationPort"`
-	TranscationID        uint16    `json:"TranscationID"`
-	View                 string    `json:"View"`
-	Domain               string    `json:"Domain"`
-	QueryClass           string    `json:"QueryClass"`
-	QueryType            string    `json:"QueryType"`
-	Rcode                string    `json:"Rcode"`
-	Response             bool      `json:"Response"`
-	Authoritative        bool      `json:"Authoritative"`
-	Truncated            bool      `json:"Truncated"`
-	RecursionDesired     bool      `json:"RecursionDesired"`
-	RecursionAvailable   bool      `json:"RecursionAvailable"`
-	Zero                 bool      `json:"Zero"`
-	AuthenticatedData    bool      `json:"AuthenticatedData"`
-	CheckingDisabled     bool      `json:"CheckingDisabled"`
-	DelayMicrosecond     int64     `json:"DelayMicrosecond"`
-	Answer               []RR      `json:"Answer"`
-	Authority            []RR      `json:"Authority"`
-	Additional           []RR      `json:"Additional"`
-	Edns                 string    `json:"Edns"`
-	EdnsClientSubnet     string    `json:"EdnsClientSubnet"`
-	EdnsClientSubnetInfo IpInfo    `json:"EdnsClientSubnetInfo"`
+	EventTime            time.Time `json:"EventTime" pb:"2"`
+	SourceIP             string    `json:"SourceIP" pb:"3"`
+	SourcePort           uint16    `json:"SourcePort" pb:"4"`
+	DestinationIP        string    `json:"DestinationIP" pb:"5"`
+	DestinationPort      uint16    `json:"DestinationPort" pb:"6"`
+	TranscationID        uint16    `json:"TranscationID" pb:"7"`
+	View                 string    `json:"View" pb:"8"`
+	Domain               string    `json:"Domain" pb:"9"`
+	QueryClass           string    `json:"QueryClass" pb:"10"`
+	QueryType            string    `json:"QueryType" pb:"11"`
+	Rcode                string    `json:"Rcode" pb:"12"`
+	Response             bool      `json:"Response" pb:"13"`
+	Authoritative        bool      `json:"Authoritative" pb:"14"`
+	Truncated            bool      `json:"Truncated" pb:"15"`
+	RecursionDesired     bool      `json:"RecursionDesired" pb:"16"`
+	RecursionAvailable   bool      `json:"RecursionAvailable" pb:"17"`
+	Zero                 bool      `json:"Zero" pb:"18"`
+	AuthenticatedData    bool      `json:"AuthenticatedData" pb:"19"`
+	CheckingDisabled     bool      `json:"CheckingDisabled" pb:"20"`
+	DelayMicrosecond     int64     `json:"DelayMicrosecond" pb:"21"`
+	Answer               []RR      `json:"Answer" pb:"22"`
+	Authority            []RR      `json:"Authority" pb:"23"`
+	Additional           []RR      `json:"Additional" pb:"24"`
+	Edns                 string    `json:"Edns" pb:"25"`
+	EdnsClientSubnet     string    `json:"EdnsClientSubnet" pb:"26"`
+	EdnsClientSubnetInfo IpInfo    `json:"EdnsClientSubnetInfo" pb:"27"`
 
 	// 扩展IP属性
-	SourceIpInfo IpInfo `json:"SourceIpInfo"`
-	AnswerIP     string `json:"AnswerIP"`
-	AnswerIpInfo IpInfo `json:"AnswerIpInfo"`
+	SourceIpInfo  IpInfo   `json:"SourceIpInfo" pb:"28"`
+	AnswerIP      string   `json:"AnswerIP" pb:"29"` // 最后一个A/AAAA记录地址，兼容保留
+	AnswerIpInfo  IpInfo   `json:"AnswerIpInfo" pb:"30"`
+	AnswerIPs     []string `json:"AnswerIPs" pb:"31"`     // 应答中与查询类型一致的全部A/AAAA记录地址
+	AnswerIpInfos []IpInfo `json:"AnswerIpInfos" pb:"32"` // 与AnswerIPs一一对应
+	CnameChain    []string `json:"CnameChain" pb:"33"`    // 从查询域名开始沿CNAME记录解析的域名链，无CNAME时为空
+	FinalTarget   string   `json:"FinalTarget" pb:"34"`   // CNAME链最终指向的域名，无CNAME时为查询域名
 
 	// 隧道安全属性
-	SecondLevelDomain     string  `yaml:"SecondLevelDomain"`
-	ByteLength            uint32  `json:"ByteLength"`
-	QueryByteLength       uint32  `json:"QueryByteLength"`
-	SubdomainByteLength   uint32  `json:"SubdomainByteLength"`
-	LabelCount            uint32  `json:"LabelCount"`
-	SubdomainLabelCount   uint32  `json:"SubdomainLabelCount"`
-	SubdomainEntropy      float64 `json:"SubdomainEntropy"`      // 子域名信息熵
-	SubdomainLabelEncoded bool    `json:"SubdomainLabelEncoded"` // 子域名是否存在特定编码，如hex|base32|base64
+	SecondLevelDomain     string  `json:"SecondLevelDomain" pb:"35"`
+	ByteLength            uint32  `json:"ByteLength" pb:"36"`
+	QueryByteLength       uint32  `json:"QueryByteLength" pb:"37"`
+	SubdomainByteLength   uint32  `json:"SubdomainByteLength" pb:"38"`
+	LabelCount            uint32  `json:"LabelCount" pb:"39"`
+	SubdomainLabelCount   uint32  `json:"SubdomainLabelCount" pb:"40"`
+	SubdomainEntropy      float64 `json:"SubdomainEntropy" pb:"41"`      // 子域名信息熵
+	SubdomainLabelEncoded bool    `json:"SubdomainLabelEncoded" pb:"42"` // 子域名是否存在特定编码，如hex|base32|base64
 
 	// 其他扩展属性
-	TrafficDirection string `json:"TrafficDirection"` // DNS事件方向，有client_query|client_response|recusion_query|recusion_response
+	TrafficDirection string `json:"TrafficDirection" pb:"43"` // DNS事件方向，有client_query|client_response|recusion_query|recusion_response
+	Transport        string `json:"Transport" pb:"44"`        // 传输层协议，有udp|tcp，dnstap输入时还可能为dot|doh
+	VlanID           uint16 `json:"VlanID" pb:"45"`           // 最内层802.1Q VLAN ID，无VLAN标签时为0
+	Vni              uint32 `json:"Vni" pb:"46"`              // VXLAN网络标识，非VXLAN封装时为0
+	UnexpectedPort   bool   `json:"UnexpectedPort" pb:"47"`   // 启发式解析模式下，两端端口均不在dns_ports中但负载可按DNS解析
+	Interface        string `json:"Interface" pb:"48"`        // 实时抓包的网卡名，离线文件及dnstap输入时为空
+	Raw              []byte `json:"Raw" pb:"49"`              // DNS消息原始报文，开启keep_raw时保留，JSON中为base64编码
+
+	// EDNS0属性，无OPT记录时均为零值
+	EdnsUdpSize       uint16    `json:"EdnsUdpSize" pb:"50"`
+	EdnsDo            bool      `json:"EdnsDo" pb:"51"`
+	EdnsVersion       uint8     `json:"EdnsVersion" pb:"52"`
+	EdnsExtendedRcode uint16    `json:"EdnsExtendedRcode" pb:"53"` // OPT中扩展RCODE高8位左移4位后的值，与头部RCODE相加为完整RCODE
+	EdnsCookieClient  string    `json:"EdnsCookieClient" pb:"54"`  // 十六进制编码
+	EdnsCookieServer  string    `json:"EdnsCookieServer" pb:"55"`  // 十六进制编码
+	EdnsNsid          string    `json:"EdnsNsid" pb:"56"`          // 十六进制编码
+	EdnsPaddingLength uint16    `json:"EdnsPaddingLength" pb:"57"`
+	EdnsKeepalive     uint16    `json:"EdnsKeepalive" pb:"58"` // TCP空闲超时，单位100毫秒
+	EdnsEde           []EdnsEde `json:"EdnsEde" pb:"59"`       // RFC 8914扩展DNS错误
+
+	// DNS头部属性，Domain/QueryClass/QueryType取自首个问题
+	Opcode          string     `json:"Opcode" pb:"60"`
+	QuestionCount   uint16     `json:"QuestionCount" pb:"61"` // 以下计数均取自报文头部，UPDATE消息中依次为ZOCOUNT/PRCOUNT/UPCOUNT/ADCOUNT
+	AnswerCount     uint16     `json:"AnswerCount" pb:"62"`
+	AuthorityCount  uint16     `json:"AuthorityCount" pb:"63"`
+	AdditionalCount uint16     `json:"AdditionalCount" pb:"64"`
+	Questions       []Question `json:"Questions" pb:"65"`
+	CountMismatch   bool       `json:"CountMismatch" pb:"66"` // 头部计数与实际解析出的记录数不一致
+
+	// 域名规范化属性，分组统计及安全分析应使用规范化域名
+	NormalizedDomain string `json:"NormalizedDomain" pb:"67"` // 小写域名，保留punycode
+	UnicodeDomain    string `json:"UnicodeDomain" pb:"68"`    // IDNA解码后的域名，解码失败时与NormalizedDomain一致
+	IdnaError        string `json:"IdnaError" pb:"69"`        // IDNA校验或解码错误，正常时为空
+
+	// 会话属性
+	TimedOut               bool      `json:"TimedOut" pb:"70"`          // 会话插件在query_timeout内未匹配到响应时生成的超时事件，其余字段为原始请求数据
+	TransactionStatus      string    `json:"TransactionStatus" pb:"71"` // 事务模式下的匹配状态，有matched|query_only|response_only，非事务模式为空
+	QueryTime              time.Time `json:"QueryTime" pb:"72"`
+	ResponseTime           time.Time `json:"ResponseTime" pb:"73"`
+	QueryRecursionDesired  bool      `json:"QueryRecursionDesired" pb:"74"` // 以下为客户端请求的标志位
+	QueryCheckingDisabled  bool      `json:"QueryCheckingDisabled" pb:"75"`
+	QueryAuthenticatedData bool      `json:"QueryAuthenticatedData" pb:"76"`
+	QueryEdnsDo            bool      `json:"QueryEdnsDo" pb:"77"`
+
+	// 重传属性
+	Attempt                     uint32 `json:"Attempt" pb:"78"`                     // 同一客户端对相同域名及类型的第几次请求，响应为所匹配请求的次数，未经会话匹配为0
+	Retransmission              bool   `json:"Retransmission" pb:"79"`              // Attempt大于1
+	FirstAnswerDelayMicrosecond int64  `json:"FirstAnswerDelayMicrosecond" pb:"80"` // 首次请求至首个成功响应的时间，仅首个成功响应填充
+	DuplicateResponse           bool   `json:"DuplicateResponse" pb:"81"`           // 同一请求已被响应过的重复响应
+
+	// 递归解析关联属性
+	ResolutionId          string `json:"ResolutionId" pb:"82"`          // 同一次递归解析的client_query/recursion_query/recursion_response/client_response共享，未关联为空
+	ResolutionMicrosecond int64  `json:"ResolutionMicrosecond" pb:"83"` // 以下仅client_response填充，client_query至client_response的总时间
+	UpstreamMicrosecond   int64  `json:"UpstreamMicrosecond" pb:"84"`   // 首个recursion_query至最后一个recursion_response的时间，未发起递归时为0
+	UpstreamQueryCount    uint32 `json:"UpstreamQueryCount" pb:"85"`    // 关联的recursion_query数
+	CacheStatus           string `json:"CacheStatus" pb:"86"`           // 仅关联成功的client_response填充，有cache_hit|cache_miss|cache_unknown
+	SharedRecursion       bool   `json:"SharedRecursion" pb:"87"`       // 仅client_response填充，本次解析未关联递归，但等待期间相同域名及类型存在由其他client_query引发的未完成递归
+}
+
+type Question struct {
+	Domain     string `json:"Domain" pb:"1"`
+	QueryClass string `json:"QueryClass" pb:"2"`
+	QueryType  string `json:"QueryType" pb:"3"`
 }
 
+type EdnsEde struct {
+	InfoCode  uint16 `json:"InfoCode" pb:"1"`
+	Name      string `json:"Name" pb:"2"`
+	ExtraText string `json:"ExtraText" pb:"3"`
+}
+
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+)
+
+const (
+	TransactionMatched      = "matched"
+	TransactionQueryOnly    = "query_only"
+	TransactionResponseOnly = "response_only"
+)
+
+const (
+	CacheHit     = "cache_hit"
+	CacheMiss    = "cache_miss"
+	CacheUnknown = "cache_unknown"
+)
+
+const (
+	ClientQueryDirection       = "client_query"
+	ClientResponseDirection    = "client_response"
+	RecursionQueryDirection    = "recursion_query"
+	RecursionResponseDirection = "recursion_response"
+)
+
 type RR struct {
-	Domain string `json:"Domain"`
-	TTL    uint32 `json:"TTL"`
-	Rclass string `json:"Rclass"`
-	Rtype  string `json:"Rtype"`
-	Rdata  string `json:"Rdata"`
+	Domain string `json:"Domain" pb:"1"`
+	TTL    uint32 `json:"TTL" pb:"2"`
+	Rclass string `json:"Rclass" pb:"3"`
+	Rtype  string `json:"Rtype" pb:"4"`
+	Rdata  string `json:"Rdata" pb:"5"` // 记录数据文本格式，兼容保留
+
+	RdataFields RdataFields `json:"RdataFields" pb:"6"`
 }
 
 type IpInfo struct {
-	IP       string `json:"IP"`
-	Country  string `json:"Country"`
-	Province string `json:"Province"`
-	City     string `json:"City"`
-	County   string `json:"County"`
-	Isp      string `json:"Isp"`
-	DC       string `json:"DC"`
-	App      string `json:"App"`
-	Custom   string `json:"Custom"`
+	IP       string `json:"IP" pb:"1"`
+	Country  string `json:"Country" pb:"2"`
+	Province string `json:"Province" pb:"3"`
+	City     string `json:"City" pb:"4"`
+	County   string `json:"County" pb:"5"`
+	Isp      string `json:"Isp" pb:"6"`
+	DC       string `json:"DC" pb:"7"`
+	App      string `json:"App" pb:"8"`
+	Custom   string `json:"Custom" pb:"9"`
+}
+
+func (e *DnsEvent) unpackMsg(payload []byte) error {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(payload); err != nil {
+		return decodeErrorf(dnsUnpackReason(err), "packet unpack to dns msg failed %s", err)
+	}
+
+	e.FromMsg(msg)
+	e.fromWireHeader(payload)
+	return nil
+}
+
+const dnsHeaderLength = 12
+
+// fromWireHeader 以报文头部计数覆盖FromMsg按解析结果填充的计数，报文截断或计数伪造时两者不一致
+func (e *DnsEvent) fromWireHeader(payload []byte) {
+	if len(payload) < dnsHeaderLength {
+		return
+	}
+
+	parsed := [4]uint16{e.QuestionCount, e.AnswerCount, e.AuthorityCount, e.AdditionalCount}
+	e.QuestionCount = binary.BigEndian.Uint16(payload[4:])
+	e.AnswerCount = binary.BigEndian.Uint16(payload[6:])
+	e.AuthorityCount = binary.BigEndian.Uint16(payload[8:])
+	e.AdditionalCount = binary.BigEndian.Uint16(payload[10:])
+	e.CountMismatch = parsed != [4]uint16{e.QuestionCount, e.AnswerCount, e.AuthorityCount, e.AdditionalCount}
+}
+
+// Reparse 基于Raw重新解析DNS消息相关字段，保留时间、地址端口及来源等数据包属性，
+// 会话、IP信息、隧道安全等扩展属性需重新经过中间件处理
+func (e *DnsEvent) Reparse() error {
+	if len(e.Raw) == 0 {
+		return fmt.Errorf("dns event raw payload missing")
+	}
+
+	n := &DnsEvent{
+		EventTime:        e.EventTime,
+		SourceIP:         e.SourceIP,
+		SourcePort:       e.SourcePort,
+		DestinationIP:    e.DestinationIP,
+		DestinationPort:  e.DestinationPort,
+		TrafficDirection: e.TrafficDirection,
+		Transport:        e.Transport,
+		VlanID:           e.VlanID,
+		Vni:              e.Vni,
+		UnexpectedPort:   e.UnexpectedPort,
+		Interface:        e.Interface,
+		Raw:              e.Raw,
+	}
+	if err := n.unpackMsg(e.Raw); err != nil {
+		return err
+	}
+	*e = *n
+	return nil
 }
 
 func (e *DnsEvent) FromMsg(msg *dns.Msg) {
 	e.TranscationID = msg.Id
+	e.Opcode = dns.OpcodeToString[msg.Opcode]
+	e.QuestionCount = uint16(len(msg.Question))
+	e.AnswerCount = uint16(len(msg.Answer))
+	e.AuthorityCount = uint16(len(msg.Ns))
+	e.AdditionalCount = uint16(len(msg.Extra))
+	e.Questions = make([]Question, 0, len(msg.Question))
+	for _, q := range msg.Question {
+		e.Questions = append(e.Questions, Question{
+			Domain:     q.Name,
+			QueryClass: dns.ClassToString[q.Qclass],
+			QueryType:  dns.TypeToString[q.Qtype],
+		})
+	}
 
 	if len(msg.Question) > 0 {
 		e.Domain = msg.Question[0].Name
@@ -86,6 +256,13 @@ func (e *DnsEvent) FromMsg(msg *dns.Msg) {
 		e.QueryType = dns.TypeToString[msg.Question[0].Qtype]
 	}
 
+	normalized, unicode, err := normalizeDomain(e.Domain)
+	e.NormalizedDomain = normalized
+	e.UnicodeDomain = unicode
+	if err != nil {
+		e.IdnaError = err.Error()
+	}
+
 	e.Rcode = dns.RcodeToString[msg.Rcode]
 	e.Response = msg.Response
 	e.Authoritative = msg.Response
@@ -97,15 +274,19 @@ func (e *DnsEvent) FromMsg(msg *dns.Msg) {
 	e.CheckingDisabled = msg.CheckingDisabled
 
 	e.Answer, _, _ = convertMsgRRs(msg.Answer)
+	e.AnswerIPs = []string{}
+	e.AnswerIpInfos = []IpInfo{}
 	if len(e.Answer) > 0 {
 		if e.QueryType == dns.TypeToString[dns.TypeA] || e.QueryType == dns.TypeToString[dns.TypeAAAA] {
 			for _, i := range e.Answer {
 				if i.Rtype == e.QueryType {
 					e.AnswerIP = i.Rdata
+					e.AnswerIPs = append(e.AnswerIPs, i.Rdata)
 				}
 			}
 		}
 	}
+	e.CnameChain, e.FinalTarget = resolveCnameChain(e.Domain, msg.Answer)
 
 	e.Authority, _, _ = convertMsgRRs(msg.Ns)
 
@@ -114,9 +295,83 @@ func (e *DnsEvent) FromMsg(msg *dns.Msg) {
 	e.Additional = add
 	e.Edns = edns
 	e.EdnsClientSubnet = ecs_ip
+	if opt := msg.IsEdns0(); opt != nil {
+		e.fromOpt(opt)
+	}
 	e.ByteLength = uint32(msg.Len())
 }
 
+// resolveCnameChain 从查询域名开始沿应答中的CNAME记录逐级解析，域名比较忽略大小写，出现环路时停止
+func resolveCnameChain(qname string, answer []dns.RR) ([]string, string) {
+	cnames := map[string]string{}
+	for _, rr := range answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			cnames[strings.ToLower(c.Hdr.Name)] = c.Target
+		}
+	}
+
+	chain := []string{}
+	target := qname
+	if len(cnames) == 0 {
+		return chain, target
+	}
+
+	seen := map[string]struct{}{}
+	for {
+		key := strings.ToLower(target)
+		if _, ok := seen[key]; ok {
+			break
+		}
+		seen[key] = struct{}{}
+
+		next, ok := cnames[key]
+		if !ok {
+			break
+		}
+		if len(chain) == 0 {
+			chain = append(chain, target)
+		}
+		chain = append(chain, next)
+		target = next
+	}
+	return chain, target
+}
+
+// dnsCookieClientLength RFC 7873客户端cookie固定8字节，其后为服务端cookie
+const dnsCookieClientLength = 8
+
+func (e *DnsEvent) fromOpt(opt *dns.OPT) {
+	e.EdnsUdpSize = opt.UDPSize()
+	e.EdnsDo = opt.Do()
+	e.EdnsVersion = opt.Version()
+	e.EdnsExtendedRcode = uint16(opt.ExtendedRcode())
+	e.EdnsEde = []EdnsEde{}
+
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_COOKIE:
+			if len(o.Cookie) > dnsCookieClientLength*2 {
+				e.EdnsCookieClient = o.Cookie[:dnsCookieClientLength*2]
+				e.EdnsCookieServer = o.Cookie[dnsCookieClientLength*2:]
+			} else {
+				e.EdnsCookieClient = o.Cookie
+			}
+		case *dns.EDNS0_NSID:
+			e.EdnsNsid = o.Nsid
+		case *dns.EDNS0_PADDING:
+			e.EdnsPaddingLength = uint16(len(o.Padding))
+		case *dns.EDNS0_TCP_KEEPALIVE:
+			e.EdnsKeepalive = o.Timeout
+		case *dns.EDNS0_EDE:
+			e.EdnsEde = append(e.EdnsEde, EdnsEde{
+				InfoCode:  o.InfoCode,
+				Name:      dns.ExtendedErrorCodeToString[o.InfoCode],
+				ExtraText: o.ExtraText,
+			})
+		}
+	}
+}
+
 func convertMsgRRs(mrrs []dns.RR) ([]RR, string, string) {
 	if len(mrrs) > 0 {
 		rrs := []RR{}
@@ -154,139 +409,9 @@ func (rr *RR) FromMsgRR(mrr dns.RR) {
 	rr.Rclass = columns[2]
 	rr.Rtype = columns[3]
 	rr.Rdata = strings.Join(columns[4:], " ")
+	rr.RdataFields = newRdataFields(mrr)
 }
 
 func (e *DnsEvent) ExecMiddlewareFunc(fn func(e *DnsEvent)) {
 	fn(e)
 }
-
-func (e *DnsEvent) JsonString() string {
-	b, _ := json.Marshal(e)
-	return string(b)
-}
-
-func (e *DnsEvent) CsvStrings() []string {
-	return []string{
-		e.EventTime.Format("2006-01-02 15:04:05.000000"),
-		e.SourceIP,
-		strconv.Itoa(int(e.SourcePort)),
-		e.DestinationIP,
-		strconv.Itoa(int(e.DestinationPort)),
-		strconv.Itoa(int(e.TranscationID)),
-		e.View,
-		e.Domain,
-		e.QueryClass,
-		e.QueryType,
-		e.Rcode,
-		strconv.FormatBool(e.Response),
-		strconv.FormatBool(e.Authoritative),
-		strconv.FormatBool(e.Truncated),
-		strconv.FormatBool(e.RecursionDesired),
-		strconv.FormatBool(e.RecursionAvailable),
-		strconv.FormatBool(e.Zero),
-		strconv.FormatBool(e.AuthenticatedData),
-		strconv.FormatBool(e.CheckingDisabled),
-		strconv.Itoa(int(e.DelayMicrosecond)),
-		rrs2String(e.Answer),
-		rrs2String(e.Authority),
-		rrs2String(e.Additional),
-		e.Edns,
-		e.EdnsClientSubnet,
-		ipinfo2String(e.EdnsClientSubnetInfo),
-		ipinfo2String(e.SourceIpInfo),
-		e.AnswerIP,
-		ipinfo2String(e.AnswerIpInfo),
-		e.SecondLevelDomain,
-		strconv.Itoa(int(e.ByteLength)),
-		strconv.Itoa(int(e.QueryByteLength)),
-		strconv.Itoa(int(e.SubdomainByteLength)),
-		strconv.Itoa(int(e.LabelCount)),
-		strconv.Itoa(int(e.SubdomainLabelCount)),
-		strconv.FormatFloat(e.SubdomainEntropy, 'f', 2, 64),
-		strconv.FormatBool(e.SubdomainLabelEncoded),
-		e.TrafficDirection,
-	}
-}
-
-func rrs2String(rrs []RR) string {
-	if len(rrs) == 0 {
-		return "[]"
-	}
-	var b1, b2 strings.Builder
-	b1.WriteString(`[`)
-
-	rrStrs := []string{}
-
-	for _, r := range rrs {
-		b2.WriteString(`{'Domain': `)
-		b2.WriteString(r.Domain)
-		b2.WriteString(`, `)
-
-		b2.WriteString(`'TTL': `)
-		b2.WriteString(strconv.FormatUint(uint64(r.TTL), 10))
-		b2.WriteString(`, `)
-
-		b2.WriteString(`'Rclass': `)
-		b2.WriteString(r.Rclass)
-		b2.WriteString(`, `)
-
-		b2.WriteString(`'Rtype': `)
-		b2.WriteString(r.Rtype)
-		b2.WriteString(`, `)
-
-		b2.WriteString(`'Rdata': `)
-		b2.WriteString(r.Rdata)
-		b2.WriteString(`}`)
-
-		rrStrs = append(rrStrs, b2.String())
-		b2.Reset()
-	}
-
-	b1.WriteString(strings.Join(rrStrs, `, `))
-	b1.WriteString(`]`)
-
-	return b1.String()
-}
-
-func ipinfo2String(i IpInfo) string {
-	var b strings.Builder
-	b.WriteString(`{`)
-
-	b.WriteString(`'IP': `)
-	b.WriteString(i.IP)
-	b.WriteString(`, `)
-
-	b.WriteString(`'Country': `)
-	b.WriteString(i.Country)
-	b.WriteString(`, `)
-
-	b.WriteString(`'Province': `)
-	b.WriteString(i.Province)
-	b.WriteString(`, `)
-
-	b.WriteString(`'City': `)
-	b.WriteString(i.City)
-	b.WriteString(`, `)
-
-	b.WriteString(`'County': `)
-	b.WriteString(i.County)
-	b.WriteString(`, `)
-
-	b.WriteString(`'Isp': `)
-	b.WriteString(i.Isp)
-	b.WriteString(`, `)
-
-	b.WriteString(`'DC': `)
-	b.WriteString(i.DC)
-	b.WriteString(`, `)
-
-	b.WriteString(`'App': `)
-	b.WriteString(i.App)
-	b.WriteString(`, `)
-
-	b.WriteString(`'Custom': `)
-	b.WriteString(i.Custom)
-	b.WriteString(`}`)
-
-	return b.String()
-}
@@ -0,0 +1,179 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReparseFromJsonRaw(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeAAAA)
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &DnsEvent{SourceIP: "10.0.0.1", DestinationPort: 53, Transport: TransportUDP}
+	if err := e.unpackMsg(payload); err != nil {
+		t.Fatal(err)
+	}
+	e.Raw = payload
+	e.SubdomainEntropy = 1.5
+
+	var decoded DnsEvent
+	if err := json.Unmarshal([]byte(e.JsonString()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Reparse(); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Domain != "example.com." || decoded.QueryType != "AAAA" || decoded.SourceIP != "10.0.0.1" || decoded.DestinationPort != 53 {
+		t.Fatalf("unexpected reparsed event %s", decoded.JsonString())
+	}
+	// 扩展属性需重新计算
+	if decoded.SubdomainEntropy != 0 {
+		t.Fatalf("expect derived fields reset, got entropy %v", decoded.SubdomainEntropy)
+	}
+
+	if err := (&DnsEvent{}).Reparse(); err == nil {
+		t.Fatal("expect error without raw payload")
+	}
+}
+
+func TestFromMsgEdns(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	m.SetEdns0(1232, true)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708a1a2a3a4a5a6a7a8"},
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus, ExtraText: "bad sig"},
+	)
+
+	e := &DnsEvent{}
+	e.FromMsg(m)
+	if e.EdnsUdpSize != 1232 || !e.EdnsDo || e.EdnsCookieClient != "0102030405060708" || e.EdnsCookieServer != "a1a2a3a4a5a6a7a8" {
+		t.Fatalf("unexpected edns fields %s", e.JsonString())
+	}
+	if len(e.EdnsEde) != 1 || e.EdnsEde[0].InfoCode != dns.ExtendedErrorCodeDNSBogus || e.EdnsEde[0].Name != "DNSSEC Bogus" {
+		t.Fatalf("unexpected ede %v", e.EdnsEde)
+	}
+}
+
+func TestFromMsgCnameChain(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.Response = true
+	for _, s := range []string{
+		"WWW.example.com. 60 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN CNAME edge.cdn.example.org.",
+		"edge.cdn.example.org. 60 IN A 192.0.2.1",
+		"edge.cdn.example.org. 60 IN A 192.0.2.2",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+
+	e := &DnsEvent{}
+	e.FromMsg(m)
+	if len(e.AnswerIPs) != 2 || e.AnswerIPs[0] != "192.0.2.1" || e.AnswerIPs[1] != "192.0.2.2" || e.AnswerIP != "192.0.2.2" {
+		t.Fatalf("unexpected answer ips %v %s", e.AnswerIPs, e.AnswerIP)
+	}
+	if len(e.CnameChain) != 3 || e.CnameChain[0] != "www.example.com." || e.FinalTarget != "edge.cdn.example.org." {
+		t.Fatalf("unexpected cname chain %v final %s", e.CnameChain, e.FinalTarget)
+	}
+}
+
+func TestRdataFields(t *testing.T) {
+	cases := map[string]func(f RdataFields) bool{
+		"example.com. 60 IN MX 10 mail.example.com.": func(f RdataFields) bool {
+			return f.Priority == 10 && f.Target == "mail.example.com."
+		},
+		"_sip._tcp.example.com. 60 IN SRV 10 20 5060 sip.example.com.": func(f RdataFields) bool {
+			return f.Priority == 10 && f.Weight == 20 && f.Port == 5060 && f.Target == "sip.example.com."
+		},
+		"example.com. 60 IN SOA ns.example.com. admin.example.com. 2024061901 7200 3600 1209600 300": func(f RdataFields) bool {
+			return f.Serial == 2024061901 && f.Mname == "ns.example.com." && f.Minimum == 300
+		},
+		`example.com. 60 IN TXT "v=spf1" "-all"`: func(f RdataFields) bool {
+			return len(f.Txt) == 2 && f.Txt[1] == "-all"
+		},
+		`example.com. 60 IN HTTPS 1 . alpn="h2,h3" port=8443`: func(f RdataFields) bool {
+			return f.Priority == 1 && len(f.SvcParams) == 2 && f.SvcParams["alpn"] == "h2,h3" && f.SvcParams["port"] == "8443"
+		},
+	}
+
+	for s, check := range cases {
+		mrr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := new(RR)
+		rr.FromMsgRR(mrr)
+		if !check(rr.RdataFields) {
+			t.Fatalf("unexpected rdata fields of %s: %+v", s, rr.RdataFields)
+		}
+	}
+}
+
+func TestUnpackHeaderCounts(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	rr, err := dns.NewRR("www.example.com. 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Insert([]dns.RR{rr})
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &DnsEvent{}
+	if err := e.unpackMsg(payload); err != nil {
+		t.Fatal(err)
+	}
+	if e.Opcode != "UPDATE" || e.QuestionCount != 1 || e.AuthorityCount != 1 || len(e.Questions) != 1 || e.Questions[0].QueryType != "SOA" || e.CountMismatch {
+		t.Fatalf("unexpected header fields %s", e.JsonString())
+	}
+
+	// 伪造头部应答计数
+	payload[7] = 2
+	e = &DnsEvent{}
+	if err := e.unpackMsg(payload); err != nil {
+		t.Fatal(err)
+	}
+	if e.AnswerCount != 2 || !e.CountMismatch {
+		t.Fatalf("expect count mismatch, got answer count %d mismatch %v", e.AnswerCount, e.CountMismatch)
+	}
+}
+
+func TestFromMsgIdn(t *testing.T) {
+	cases := []struct {
+		qname      string
+		normalized string
+		unicode    string
+		idnaError  bool
+	}{
+		{"WWW.Example.COM.", "www.example.com.", "www.example.com.", false},
+		{"XN--55QX5D.xn--fiqs8s.", "xn--55qx5d.xn--fiqs8s.", "公司.中国.", false},
+		{"_sip._tcp.example.com.", "_sip._tcp.example.com.", "_sip._tcp.example.com.", false},
+		{"xn--zz.example.com.", "xn--zz.example.com.", "xn--zz.example.com.", true},
+	}
+
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.SetQuestion(c.qname, dns.TypeA)
+		e := &DnsEvent{}
+		e.FromMsg(m)
+		if e.Domain != c.qname || e.NormalizedDomain != c.normalized || e.UnicodeDomain != c.unicode || (e.IdnaError != "") != c.idnaError {
+			t.Fatalf("unexpected idn fields of %s: %s %s %q", c.qname, e.NormalizedDomain, e.UnicodeDomain, e.IdnaError)
+		}
+	}
+}
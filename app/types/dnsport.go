@@ -0,0 +1,31 @@
+package types
+
+// DefaultDnsPorts 未配置dns_ports时使用的默认端口
+var DefaultDnsPorts = []uint16{53}
+
+// PortSet DNS服务端口集合，用于判断流量方向及传输层是否为DNS
+type PortSet map[uint16]struct{}
+
+func NewPortSet(ports []uint16) PortSet {
+	if len(ports) == 0 {
+		ports = DefaultDnsPorts
+	}
+	s := PortSet{}
+	for _, p := range ports {
+		s[p] = struct{}{}
+	}
+	return s
+}
+
+func (s PortSet) Contains(port uint16) bool {
+	_, ok := s[port]
+	return ok
+}
+
+type DecodeOptions struct {
+	DnsPorts []uint16
+	// Heuristic 开启后非DNS端口的UDP负载也尝试按DNS解析，成功则标记UnexpectedPort
+	Heuristic bool
+	// KeepRaw 保留DNS消息原始报文
+	KeepRaw bool
+}
@@ -0,0 +1,273 @@
+package types
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+)
+
+type DnstapSocketType string
+
+const (
+	DnstapSocketUnix DnstapSocketType = "unix"
+	DnstapSocketTcp  DnstapSocketType = "tcp"
+	DnstapSocketFile DnstapSocketType = "file"
+)
+
+// dnstap消息类型与流量方向的映射，未列出的类型（stub/tool/update等）直接忽略
+var dnstapDirections = map[dnstap.Message_Type]string{
+	dnstap.Message_CLIENT_QUERY:       ClientQueryDirection,
+	dnstap.Message_AUTH_QUERY:         ClientQueryDirection,
+	dnstap.Message_CLIENT_RESPONSE:    ClientResponseDirection,
+	dnstap.Message_AUTH_RESPONSE:      ClientResponseDirection,
+	dnstap.Message_RESOLVER_QUERY:     RecursionQueryDirection,
+	dnstap.Message_FORWARDER_QUERY:    RecursionQueryDirection,
+	dnstap.Message_RESOLVER_RESPONSE:  RecursionResponseDirection,
+	dnstap.Message_FORWARDER_RESPONSE: RecursionResponseDirection,
+}
+
+func NewDnstapSource(ctx context.Context, workerCount int, socketType DnstapSocketType, address string, keepRaw bool, finalizer func()) *DnstapEventSource {
+	s := &DnstapEventSource{
+		ctx:        ctx,
+		socketType: socketType,
+		address:    address,
+		keepRaw:    keepRaw,
+		frameCh:    make(chan []byte, chBufferLength),
+		eventCh:    make(chan *DnsEvent, chBufferLength),
+		errEventCh: make(chan *ErrEvent, chBufferLength),
+		workers:    newDecodeWorkers(workerCount),
+		done:       make(chan struct{}),
+		finalizer:  finalizer,
+		closeOnce:  sync.Once{},
+	}
+
+	go s.run()
+	return s
+}
+
+type DnstapEventSource struct {
+	ctx        context.Context
+	socketType DnstapSocketType
+	address    string
+	keepRaw    bool
+	frameCh    chan []byte
+	eventCh    chan *DnsEvent
+	errEventCh chan *ErrEvent
+	workers    *decodeWorkers
+	finalizer  func()
+	closeOnce  sync.Once
+	// done 关闭后阻塞中的发送直接放弃，closed置位后不再发送，避免向已关闭的通道发送
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (s *DnstapEventSource) Events() <-chan *DnsEvent {
+	return s.eventCh
+}
+
+func (s *DnstapEventSource) ErrEvents() <-chan *ErrEvent {
+	return s.errEventCh
+}
+
+func (s *DnstapEventSource) Stats() SourceStats {
+	return SourceStats{}
+}
+
+func (s *DnstapEventSource) run() {
+	switch s.socketType {
+	case DnstapSocketUnix:
+		input, err := dnstap.NewFrameStreamSockInputFromPath(s.address)
+		if err != nil {
+			logger.Fatalf("listen dnstap unix socket %s failed %s", s.address, err)
+		}
+		logger.Infof("listen dnstap unix socket %s succeed", s.address)
+		go input.ReadInto(s.frameCh)
+	case DnstapSocketTcp:
+		l, err := net.Listen("tcp", s.address)
+		if err != nil {
+			logger.Fatalf("listen dnstap tcp %s failed %s", s.address, err)
+		}
+		logger.Infof("listen dnstap tcp %s succeed", s.address)
+		go dnstap.NewFrameStreamSockInput(l).ReadInto(s.frameCh)
+	case DnstapSocketFile:
+		input, err := dnstap.NewFrameStreamInputFromFilename(s.address)
+		if err != nil {
+			logger.Fatalf("open dnstap file %s failed %s", s.address, err)
+		}
+		logger.Infof("begin handle dnstap file %s", s.address)
+		go func() {
+			input.ReadInto(s.frameCh)
+			logger.Infof("end handle dnstap file %s", s.address)
+			close(s.frameCh)
+		}()
+	default:
+		logger.Fatalf("unknown dnstap socket type %s", s.socketType)
+	}
+
+	s.handleFrames()
+}
+
+func (s *DnstapEventSource) handleFrames() {
+	for {
+		select {
+		case frame, ok := <-s.frameCh:
+			if !ok {
+				logger.Infof("handle dnstap frames groutinue exiting by file EOF")
+				s.close()
+				return
+			}
+			// 帧在读取协程中反序列化，按客户端地址分发，同一客户端的请求与响应按到达顺序解析DNS消息
+			d, err := unmarshalDnstap(frame)
+			if err != nil {
+				s.unpackFailed(err)
+				continue
+			}
+			s.workers.submit(dnstapFlowHash(d), func() {
+				e, err := unpackDnstapMessage(d, s.keepRaw)
+				if err != nil {
+					s.unpackFailed(err)
+					return
+				}
+				if e != nil {
+					s.emit(e)
+				}
+			})
+		case <-s.ctx.Done():
+			logger.Infof("handle dnstap frames groutinue exiting by receive signal")
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *DnstapEventSource) unpackFailed(err error) {
+	logger.Debugf("unpack dnstap frame failed %s", err)
+	s.emitErr(&ErrEvent{Time: time.Now(), Reason: errReason(err), Err: err})
+}
+
+func (s *DnstapEventSource) emit(e *DnsEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.eventCh <- e:
+	case <-s.done:
+	}
+}
+
+func (s *DnstapEventSource) emitErr(e *ErrEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.errEventCh <- e:
+	case <-s.done:
+	}
+}
+
+// close 先等待worker处理完已提交的帧，超时仍未结束的worker其后的发送被丢弃，全部worker退出后关闭输出通道
+func (s *DnstapEventSource) close() {
+	s.closeOnce.Do(func() {
+		err := s.workers.release(time.Second * 3)
+		close(s.done)
+		if err != nil {
+			logger.Errorf("event srouce %s", err)
+			s.workers.wait()
+		}
+		s.mu.Lock()
+		s.closed = true
+		close(s.eventCh)
+		close(s.errEventCh)
+		s.mu.Unlock()
+		s.finalizer()
+		logger.Infof("event source finalizer succeed")
+	})
+}
+
+// unpackDnstap 解析单个dnstap帧，不关心的消息类型返回nil事件
+func unpackDnstap(frame []byte, keepRaw bool) (*DnsEvent, error) {
+	d, err := unmarshalDnstap(frame)
+	if err != nil {
+		return nil, err
+	}
+	return unpackDnstapMessage(d, keepRaw)
+}
+
+func unmarshalDnstap(frame []byte) (*dnstap.Dnstap, error) {
+	d := &dnstap.Dnstap{}
+	if err := proto.Unmarshal(frame, d); err != nil {
+		return nil, decodeErrorf(ErrReasonDnstap, "dnstap frame unmarshal failed %s", err)
+	}
+	return d, nil
+}
+
+// dnstapFlowHash 请求与响应消息均携带发起方地址端口，按此计算哈希
+func dnstapFlowHash(d *dnstap.Dnstap) uint32 {
+	m := d.GetMessage()
+	h := fnv.New32a()
+	h.Write(m.GetQueryAddress())
+	port := m.GetQueryPort()
+	h.Write([]byte{byte(port >> 8), byte(port)})
+	return h.Sum32()
+}
+
+func unpackDnstapMessage(d *dnstap.Dnstap, keepRaw bool) (*DnsEvent, error) {
+	m := d.GetMessage()
+	if d.GetType() != dnstap.Dnstap_MESSAGE || m == nil {
+		return nil, nil
+	}
+
+	direction, ok := dnstapDirections[m.GetType()]
+	if !ok {
+		return nil, nil
+	}
+
+	e := &DnsEvent{
+		TrafficDirection: direction,
+		Transport:        strings.ToLower(m.GetSocketProtocol().String()),
+	}
+
+	queryIP := net.IP(m.GetQueryAddress()).String()
+	responseIP := net.IP(m.GetResponseAddress()).String()
+	queryPort := uint16(m.GetQueryPort())
+	responsePort := uint16(m.GetResponsePort())
+
+	var wire []byte
+	switch direction {
+	case ClientQueryDirection, RecursionQueryDirection:
+		e.EventTime = time.Unix(int64(m.GetQueryTimeSec()), int64(m.GetQueryTimeNsec()))
+		e.SourceIP, e.SourcePort = queryIP, queryPort
+		e.DestinationIP, e.DestinationPort = responseIP, responsePort
+		wire = m.GetQueryMessage()
+	default:
+		e.EventTime = time.Unix(int64(m.GetResponseTimeSec()), int64(m.GetResponseTimeNsec()))
+		e.SourceIP, e.SourcePort = responseIP, responsePort
+		e.DestinationIP, e.DestinationPort = queryIP, queryPort
+		wire = m.GetResponseMessage()
+	}
+
+	if len(wire) == 0 {
+		return nil, decodeErrorf(ErrReasonDnstap, "dnstap %s message missing dns payload", m.GetType())
+	}
+
+	if err := e.unpackMsg(wire); err != nil {
+		return nil, err
+	}
+	if keepRaw {
+		e.Raw = wire
+	}
+	return e, nil
+}
@@ -0,0 +1,156 @@
+package types
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func dnstapFrame(t *testing.T, m *dnstap.Message) []byte {
+	typ := dnstap.Dnstap_MESSAGE
+	b, err := proto.Marshal(&dnstap.Dnstap{Type: &typ, Message: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUnpackDnstap(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	query, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	response, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	family4, family6 := dnstap.SocketFamily_INET, dnstap.SocketFamily_INET6
+	udp := dnstap.SocketProtocol_UDP
+	clientQuery, clientResponse := dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE
+	resolverQuery, resolverResponse := dnstap.Message_RESOLVER_QUERY, dnstap.Message_RESOLVER_RESPONSE
+	queryPort, responsePort := uint32(40000), uint32(53)
+	querySec, responseSec := uint64(1718789687), uint64(1718789688)
+
+	message := func(typ *dnstap.Message_Type, family *dnstap.SocketFamily, queryIP, responseIP net.IP, queryMsg, responseMsg []byte) *dnstap.Message {
+		return &dnstap.Message{
+			Type:            typ,
+			SocketFamily:    family,
+			SocketProtocol:  &udp,
+			QueryAddress:    queryIP,
+			ResponseAddress: responseIP,
+			QueryPort:       &queryPort,
+			ResponsePort:    &responsePort,
+			QueryTimeSec:    &querySec,
+			ResponseTimeSec: &responseSec,
+			QueryMessage:    queryMsg,
+			ResponseMessage: responseMsg,
+		}
+	}
+	client4, server4 := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.53").To4()
+	client6, server6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::53")
+
+	cases := []struct {
+		name      string
+		message   *dnstap.Message
+		direction string
+		src       string
+		dst       string
+		srcPort   uint16
+		eventSec  int64
+		response  bool
+		err       bool
+	}{
+		{"client query", message(&clientQuery, &family4, client4, server4, query, nil), ClientQueryDirection, "10.0.0.1", "10.0.0.53", 40000, int64(querySec), false, false},
+		{"client response", message(&clientResponse, &family4, client4, server4, query, response), ClientResponseDirection, "10.0.0.53", "10.0.0.1", 53, int64(responseSec), true, false},
+		{"resolver query", message(&resolverQuery, &family4, client4, server4, query, nil), RecursionQueryDirection, "10.0.0.1", "10.0.0.53", 40000, int64(querySec), false, false},
+		{"resolver response", message(&resolverResponse, &family4, client4, server4, nil, response), RecursionResponseDirection, "10.0.0.53", "10.0.0.1", 53, int64(responseSec), true, false},
+		{"missing response message", message(&clientResponse, &family4, client4, server4, query, nil), "", "", "", 0, 0, false, true},
+		{"ipv6 client query", message(&clientQuery, &family6, client6, server6, query, nil), ClientQueryDirection, "2001:db8::1", "2001:db8::53", 40000, int64(querySec), false, false},
+		{"ipv6 client response", message(&clientResponse, &family6, client6, server6, query, response), ClientResponseDirection, "2001:db8::53", "2001:db8::1", 53, int64(responseSec), true, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, err := unpackDnstap(dnstapFrame(t, c.message), false)
+			if c.err {
+				if err == nil || errReason(err) != ErrReasonDnstap {
+					t.Fatalf("expect dnstap error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.TrafficDirection != c.direction || e.SourceIP != c.src || e.DestinationIP != c.dst || e.SourcePort != c.srcPort {
+				t.Fatalf("unexpected event %s %s:%d->%s:%d", e.TrafficDirection, e.SourceIP, e.SourcePort, e.DestinationIP, e.DestinationPort)
+			}
+			if e.EventTime.Unix() != c.eventSec || e.Response != c.response || e.Transport != "udp" || e.Domain != "example.com." {
+				t.Fatalf("unexpected event time %s response %v transport %s domain %s", e.EventTime, e.Response, e.Transport, e.Domain)
+			}
+		})
+	}
+}
+
+func TestDnstapSourceClose(t *testing.T) {
+	s := &DnstapEventSource{
+		ctx:        context.Background(),
+		eventCh:    make(chan *DnsEvent),
+		errEventCh: make(chan *ErrEvent),
+		done:       make(chan struct{}),
+		workers:    newDecodeWorkers(1),
+		finalizer:  func() {},
+	}
+
+	// 关闭前提交的帧在worker释放前处理完成，事件先于通道关闭送达
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range s.eventCh {
+			n += 1
+		}
+		received <- n
+	}()
+	s.workers.submit(0, func() {
+		time.Sleep(time.Millisecond * 50)
+		s.emit(&DnsEvent{})
+	})
+	s.close()
+	if n := <-received; n != 1 {
+		t.Fatalf("expect 1 event before close, got %d", n)
+	}
+
+	// 关闭后的迟到发送直接丢弃，不应panic或阻塞
+	s.emit(&DnsEvent{})
+	s.emitErr(&ErrEvent{})
+}
+
+func TestDnstapSourceCloseBlockedSend(t *testing.T) {
+	s := &DnstapEventSource{
+		ctx:        context.Background(),
+		eventCh:    make(chan *DnsEvent),
+		errEventCh: make(chan *ErrEvent),
+		done:       make(chan struct{}),
+		workers:    newDecodeWorkers(1),
+		finalizer:  func() {},
+	}
+
+	// 无人消费时阻塞中的发送在关闭时放弃
+	sent := make(chan struct{})
+	go func() {
+		s.emit(&DnsEvent{})
+		close(sent)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	s.close()
+	<-sent
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+type ErrReason string
+
+const (
+	ErrReasonUnknown          ErrReason = "unknown"
+	ErrReasonMetadataMissing  ErrReason = "metadata_missing"
+	ErrReasonLinkDecode       ErrReason = "link_decode"
+	ErrReasonNoIPLayer        ErrReason = "no_ip_layer"
+	ErrReasonFragment         ErrReason = "fragment"
+	ErrReasonNoTransportLayer ErrReason = "no_transport_layer"
+	ErrReasonNotDnsPort       ErrReason = "not_dns_port"
+	ErrReasonDnsTruncated     ErrReason = "dns_truncated"
+	ErrReasonDnsMalformed     ErrReason = "dns_malformed"
+	ErrReasonTcpStream        ErrReason = "tcp_stream"
+	ErrReasonDnstap           ErrReason = "dnstap"
+)
+
+// ErrEvent 解析失败事件，数据包级错误携带原始数据以便隔离保存，TCP流及dnstap错误的Data为空
+type ErrEvent struct {
+	Time        time.Time
+	Reason      ErrReason
+	Err         error
+	Interface   string
+	LinkType    layers.LinkType
+	CaptureInfo gopacket.CaptureInfo
+	Data        []byte
+}
+
+// DecodeError 带原因分类的解析错误
+type DecodeError struct {
+	Reason ErrReason
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func decodeErrorf(reason ErrReason, format string, args ...any) error {
+	return &DecodeError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+func errReason(err error) ErrReason {
+	var de *DecodeError
+	if errors.As(err, &de) {
+		return de.Reason
+	}
+	return ErrReasonUnknown
+}
+
+// miekg/dns导出的解析错误，按DNS负载被截断与格式错误分类
+var (
+	dnsTruncatedErrs = []error{dns.ErrShortRead, dns.ErrBuf}
+	dnsMalformedErrs = []error{dns.ErrRdata, dns.ErrLongDomain, dns.ErrRcode, dns.ErrExtendedRcode}
+)
+
+// dnsUnpackReason 区分DNS负载被截断与格式错误
+func dnsUnpackReason(err error) ErrReason {
+	for _, target := range dnsTruncatedErrs {
+		if errors.Is(err, target) {
+			return ErrReasonDnsTruncated
+		}
+	}
+	for _, target := range dnsMalformedErrs {
+		if errors.Is(err, target) {
+			return ErrReasonDnsMalformed
+		}
+	}
+
+	// 头部、整数及地址等字段读越界时的错误未导出，仅能按错误文本识别
+	var de *dns.Error
+	if errors.As(err, &de) && strings.Contains(de.Error(), "overflow") {
+		return ErrReasonDnsTruncated
+	}
+	return ErrReasonDnsMalformed
+}
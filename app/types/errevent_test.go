@@ -0,0 +1,70 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsUnpackReasonCases(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	rr, err := dns.NewRR("www.example.com. 60 IN A 1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answer = append(m.Answer, rr)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 标签长度超过63
+	longLabel := append([]byte{}, b[:12]...)
+	longLabel[5] = 1
+	longLabel = append(longLabel, 70)
+	longLabel = append(longLabel, make([]byte, 70)...)
+	longLabel = append(longLabel, 0, 0, 1, 0, 1)
+
+	// 压缩指针指向自身
+	pointerLoop := append([]byte{}, b[:12]...)
+	pointerLoop[5] = 1
+	pointerLoop = append(pointerLoop, 0xc0, 12, 0, 1, 0, 1)
+
+	cases := []struct {
+		name    string
+		payload []byte
+		reason  ErrReason
+	}{
+		{"header truncated", b[:5], ErrReasonDnsTruncated},
+		{"question truncated", b[:15], ErrReasonDnsTruncated},
+		{"rdata truncated", b[:len(b)-2], ErrReasonDnsTruncated},
+		{"label too long", longLabel, ErrReasonDnsMalformed},
+		{"compression pointer loop", pointerLoop, ErrReasonDnsMalformed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := (&DnsEvent{}).unpackMsg(c.payload)
+			if err == nil {
+				t.Fatal("expect unpack error")
+			}
+			if r := errReason(err); r != c.reason {
+				t.Fatalf("expect %s, got %s (%s)", c.reason, r, err)
+			}
+		})
+	}
+
+	// 导出错误按errors.Is识别，不依赖错误文本
+	for err, reason := range map[error]ErrReason{
+		dns.ErrShortRead:                            ErrReasonDnsTruncated,
+		fmt.Errorf("wrapped %w", dns.ErrBuf):        ErrReasonDnsTruncated,
+		dns.ErrRdata:                                ErrReasonDnsMalformed,
+		fmt.Errorf("wrapped %w", dns.ErrLongDomain): ErrReasonDnsMalformed,
+		fmt.Errorf("overflow not from dns"):         ErrReasonDnsMalformed,
+	} {
+		if r := dnsUnpackReason(err); r != reason {
+			t.Fatalf("%s: expect %s, got %s", err, reason, r)
+		}
+	}
+}
@@ -9,62 +9,126 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/miekg/dns"
-	"github.com/panjf2000/ants/v2"
 
 	"github.com/hiwyw/dnscap-tool/app/logger"
 )
 
-const chBufferLength = 10
+const (
+	chBufferLength = 10
+
+	defaultSnapLen = 65535
+)
 
 type EventSource interface {
 	Events() <-chan *DnsEvent
-	ErrEvents() <-chan struct{}
-	SetWorkerCount(n int)
+	ErrEvents() <-chan *ErrEvent
+	Stats() SourceStats
 }
 
-func NewCaptureSource(ctx context.Context, workerCount int, device, bpf string, finalizer func()) *PcapEventSource {
-	return NewPacketEventSource(ctx, workerCount, PcapModeCapture, []string{}, device, bpf, finalizer)
+type SourceStats struct {
+	DefragReassembled uint64 `json:"defrag_reassembled_count"`
+	DefragExpired     uint64 `json:"defrag_expired_count"`
+	DefragOrphaned    uint64 `json:"defrag_orphaned_count"`
+	KernelPackets     uint64 `json:"kernel_packets_count,omitempty"`
+	KernelDrops       uint64 `json:"kernel_drops_count,omitempty"`
+	KernelFreezes     uint64 `json:"kernel_freezes_count,omitempty"`
+}
+
+type CaptureMode string
+
+const (
+	CaptureModePcap     CaptureMode = "pcap"
+	CaptureModeAfpacket CaptureMode = "afpacket"
+)
+
+type CaptureOptions struct {
+	Mode          CaptureMode
+	SnapLen       int
+	RingSizeMB    int
+	BlockSizeKB   int
+	FanoutGroup   uint16
+	FanoutType    string
+	FanoutReaders int
 }
 
-func NewFilesSource(ctx context.Context, workerCount int, files []string, bpf string, finalizer func()) *PcapEventSource {
-	return NewPacketEventSource(ctx, workerCount, PcapModeFile, files, "", bpf, finalizer)
+// CaptureDevice 实时抓包网卡，每个网卡使用独立的bpf过滤器
+type CaptureDevice struct {
+	Name      string
+	BpfFilter string
 }
 
-func NewPacketEventSource(ctx context.Context, workerCount int, mode PcapMode, files []string, device, bpf string, finalizer func()) *PcapEventSource {
-	s := &PcapEventSource{
-		ctx:        ctx,
-		mode:       mode,
-		files:      files,
-		device:     device,
-		bpfFilter:  bpf,
-		eventCh:    make(chan *DnsEvent, chBufferLength),
-		errEventCh: make(chan struct{}, chBufferLength),
-		finalizer:  finalizer,
-		closeOnce:  sync.Once{},
-	}
-
-	pool, err := ants.NewPool(workerCount)
-	if err != nil {
-		logger.Fatal(err)
+func NewCaptureSource(ctx context.Context, workerCount int, devices []CaptureDevice, decodeOpts DecodeOptions, opts CaptureOptions, finalizer func()) *PcapEventSource {
+	return NewPacketEventSource(ctx, workerCount, PcapModeCapture, []string{}, devices, "", decodeOpts, opts, finalizer)
+}
+
+func NewFilesSource(ctx context.Context, workerCount int, files []string, bpf string, decodeOpts DecodeOptions, fileOpts FileOptions, finalizer func()) *PcapEventSource {
+	s := newPcapEventSource(ctx, workerCount, PcapModeFile, files, nil, bpf, decodeOpts, CaptureOptions{}, finalizer)
+	if fileOpts.ReplaySpeed > 0 {
+		s.replay = newReplayClock(fileOpts.ReplaySpeed)
 	}
-	s.pool = pool
+	s.bounds = newPacketBounds(fileOpts)
+	go s.run()
+	return s
+}
 
+func NewPacketEventSource(ctx context.Context, workerCount int, mode PcapMode, files []string, devices []CaptureDevice, bpf string, decodeOpts DecodeOptions, opts CaptureOptions, finalizer func()) *PcapEventSource {
+	s := newPcapEventSource(ctx, workerCount, mode, files, devices, bpf, decodeOpts, opts, finalizer)
 	go s.run()
 	return s
 }
 
+func newPcapEventSource(ctx context.Context, workerCount int, mode PcapMode, files []string, devices []CaptureDevice, bpf string, decodeOpts DecodeOptions, opts CaptureOptions, finalizer func()) *PcapEventSource {
+	if opts.SnapLen <= 0 {
+		opts.SnapLen = defaultSnapLen
+	}
+
+	s := &PcapEventSource{
+		ctx:         ctx,
+		mode:        mode,
+		files:       files,
+		devices:     devices,
+		bpfFilter:   bpf,
+		captureOpts: opts,
+		dnsPorts:    NewPortSet(decodeOpts.DnsPorts),
+		heuristic:   decodeOpts.Heuristic,
+		keepRaw:     decodeOpts.KeepRaw,
+		eventCh:     make(chan *DnsEvent, chBufferLength),
+		errEventCh:  make(chan *ErrEvent, chBufferLength),
+		finalizer:   finalizer,
+		closeOnce:   sync.Once{},
+	}
+	// TCP流按网卡分别重组，离线文件无网卡名
+	s.tcp = map[string]*tcpReassembler{"": s.newTcpReassembler("")}
+	for _, d := range devices {
+		s.tcp[d.Name] = s.newTcpReassembler(d.Name)
+	}
+	s.defrag = newDefragmenter()
+	s.workers = newDecodeWorkers(workerCount)
+	return s
+}
+
 type PcapEventSource struct {
-	ctx        context.Context
-	mode       PcapMode
-	files      []string
-	device     string
-	bpfFilter  string
-	eventCh    chan *DnsEvent
-	errEventCh chan struct{}
-	pool       *ants.Pool
-	finalizer  func()
-	closeOnce  sync.Once
+	ctx         context.Context
+	mode        PcapMode
+	files       []string
+	devices     []CaptureDevice
+	bpfFilter   string
+	captureOpts CaptureOptions
+	watchOpts   WatchOptions
+	dnsPorts    PortSet
+	heuristic   bool
+	keepRaw     bool
+	replay      *replayClock
+	bounds      *packetBounds
+	eventCh     chan *DnsEvent
+	errEventCh  chan *ErrEvent
+	workers     *decodeWorkers
+	tcp         map[string]*tcpReassembler
+	defrag      *defragmenter
+	ringMu      sync.Mutex
+	rings       []*afpacketRing
+	finalizer   func()
+	closeOnce   sync.Once
 }
 
 type PcapMode string
@@ -72,18 +136,32 @@ type PcapMode string
 const (
 	PcapModeFile    PcapMode = "file"
 	PcapModeCapture PcapMode = "capture"
+	PcapModeWatch   PcapMode = "watch"
 )
 
 func (s *PcapEventSource) Events() <-chan *DnsEvent {
 	return s.eventCh
 }
 
-func (s *PcapEventSource) SetWorkerCount(n int) {
-	s.pool.Tune(n)
+func (s *PcapEventSource) ErrEvents() <-chan *ErrEvent {
+	return s.errEventCh
 }
 
-func (s *PcapEventSource) ErrEvents() <-chan struct{} {
-	return s.errEventCh
+func (s *PcapEventSource) Stats() SourceStats {
+	stats := SourceStats{
+		DefragReassembled: s.defrag.reassembled.Load(),
+		DefragExpired:     s.defrag.expired.Load(),
+		DefragOrphaned:    s.defrag.orphaned.Load(),
+	}
+	s.ringMu.Lock()
+	defer s.ringMu.Unlock()
+	for _, ring := range s.rings {
+		packets, drops, freezes := ring.stats()
+		stats.KernelPackets += packets
+		stats.KernelDrops += drops
+		stats.KernelFreezes += freezes
+	}
+	return stats
 }
 
 func (s *PcapEventSource) run() {
@@ -92,30 +170,52 @@ func (s *PcapEventSource) run() {
 		s.handleCapture()
 	case PcapModeFile:
 		s.handleFiles()
+	case PcapModeWatch:
+		s.handleWatch()
 	default:
 		logger.Fatalf("unknown pcap mode %s", s.mode)
 	}
 }
 
+// handleCapture 各网卡并行抓包，全部网卡退出后关闭事件源
 func (s *PcapEventSource) handleCapture() {
-	handle, err := pcap.OpenLive(s.device, 1500, true, pcap.BlockForever)
+	wg := sync.WaitGroup{}
+	for _, d := range s.devices {
+		wg.Add(1)
+		go func(d CaptureDevice) {
+			defer wg.Done()
+			s.handleDevice(d)
+		}(d)
+	}
+	wg.Wait()
+	s.close()
+}
+
+func (s *PcapEventSource) handleDevice(d CaptureDevice) {
+	if s.captureOpts.Mode == CaptureModeAfpacket {
+		s.handleAfpacket(d)
+		return
+	}
+
+	handle, err := pcap.OpenLive(d.Name, int32(s.captureOpts.SnapLen), true, pcap.BlockForever)
 	if err != nil {
-		logger.Fatalf("open pcap device %s failed %s", s.device, err)
+		logger.Fatalf("open pcap device %s failed %s", d.Name, err)
 		return
 	}
 	defer handle.Close()
 
-	if err := handle.SetBPFFilter(s.bpfFilter); err != nil {
-		logger.Fatalf("set bfp filter failed [%s] %s", s.bpfFilter, err)
+	if err := handle.SetBPFFilter(d.BpfFilter); err != nil {
+		logger.Fatalf("set bfp filter failed [%s] %s", d.BpfFilter, err)
 		return
 	}
-	logger.Infof("set bpf filter succeed [%s]", s.bpfFilter)
+	logger.Infof("set device %s bpf filter succeed [%s]", d.Name, d.BpfFilter)
 
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	s.handlePackets(packetSource)
+	s.handlePackets(packetSource, handle.LinkType(), d.Name)
 }
 
 func (s *PcapEventSource) handleFiles() {
+	s.files = expandCaptureFiles(s.files)
 	logger.Infof("total %d pcap files need to handle", len(s.files))
 	for _, f := range s.files {
 		logger.Infof("begin handle pcap file %s", f)
@@ -123,12 +223,24 @@ func (s *PcapEventSource) handleFiles() {
 			logger.Errorf("handle pcap file %s failed %s", f, err)
 		}
 		logger.Infof("end handle pcap file %s", f)
+		if s.bounds.finished() {
+			logger.Infof("stop handle pcap files by reaching end_time or max_packets")
+			break
+		}
 	}
 	logger.Infof("all %d pcap files handled done", len(s.files))
 	s.close()
 }
 
 func (s *PcapEventSource) handleFile(filename string) error {
+	compressed, err := isCompressedFile(filename)
+	if err != nil {
+		return fmt.Errorf("open pacp file %s failed %s", filename, err)
+	}
+	if compressed {
+		return s.handleCompressedFile(filename)
+	}
+
 	handle, err := pcap.OpenOffline(filename)
 	if err != nil {
 		return fmt.Errorf("open pacp file %s failed %s", filename, err)
@@ -140,37 +252,77 @@ func (s *PcapEventSource) handleFile(filename string) error {
 	}
 	logger.Infof("set bpf filter succeed [%s]", s.bpfFilter)
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	s.handlePackets(packetSource)
-	return nil
+	source := &readErrSource{source: handle}
+	packetSource := gopacket.NewPacketSource(source, handle.LinkType())
+	s.handlePackets(packetSource, handle.LinkType(), "")
+	return source.Err()
 }
 
-func (s *PcapEventSource) handlePackets(ps *gopacket.PacketSource) {
+func (s *PcapEventSource) handleCompressedFile(filename string) error {
+	source, linkType, closer, err := openCaptureFile(filename)
+	if err != nil {
+		return fmt.Errorf("open pacp file %s failed %s", filename, err)
+	}
+	defer closer.Close()
+
+	// 未配置过滤器时逐包匹配无意义，不编译
+	var filter *pcap.BPF
+	if s.bpfFilter != "" {
+		filter, err = pcap.NewBPF(linkType, s.captureOpts.SnapLen, s.bpfFilter)
+		if err != nil {
+			return fmt.Errorf("set bpf filter failed [%s] %s", s.bpfFilter, err)
+		}
+		logger.Infof("set bpf filter succeed [%s]", s.bpfFilter)
+	}
+
+	errSource := &readErrSource{source: &bpfPacketDataSource{source: source, filter: filter}}
+	packetSource := gopacket.NewPacketSource(errSource, linkType)
+	s.handlePackets(packetSource, linkType, "")
+	return errSource.Err()
+}
+
+// handlePackets iface为抓包网卡名，离线文件为空
+func (s *PcapEventSource) handlePackets(ps *gopacket.PacketSource, linkType layers.LinkType, iface string) {
+	tcp := s.tcp[iface]
 	for {
 		select {
 		case p, ok := <-ps.Packets():
 			if !ok {
 				if s.mode == PcapModeCapture {
-					logger.Infof("handle packets groutinue exiting by no packets")
-					s.close()
+					logger.Infof("handle packets groutinue of device %s exiting by no packets", iface)
 				}
-				if s.mode == PcapModeFile {
+				if s.mode == PcapModeFile || s.mode == PcapModeWatch {
 					logger.Infof("handle packets groutinue exiting by file EOF")
 				}
 				return
 			}
-			s.pool.Submit(func() {
-				if p == nil {
+			if p == nil {
+				continue
+			}
+			if md := p.Metadata(); md != nil {
+				if !s.bounds.accept(md.Timestamp) {
+					if s.bounds.finished() {
+						logger.Infof("handle packets groutinue exiting by reaching end_time or max_packets")
+						return
+					}
+					continue
+				}
+				if !s.replay.wait(s.ctx, md.Timestamp) {
+					logger.Infof("handle packets groutinue exiting by receive signal")
+					s.close()
 					return
 				}
-
-				e, err := unpack(p)
+				tcp.flushIfNeed(md.Timestamp)
+			}
+			s.workers.submit(packetFlowHash(p), func() {
+				e, err := s.unpack(p, iface)
 				if err != nil {
-					logger.Debugf("unpack packet failed %s", err)
-					s.errEventCh <- struct{}{}
+					s.emitPacketErr(err, p, linkType, iface)
 					return
 				}
-				s.eventCh <- e
+				if e != nil {
+					s.emit(e)
+				}
 			})
 		case <-s.ctx.Done():
 			logger.Infof("handle packets groutinue exiting by receive signal")
@@ -180,10 +332,23 @@ func (s *PcapEventSource) handlePackets(ps *gopacket.PacketSource) {
 	}
 }
 
+// packetFlowHash 按外层网络层地址计算对称哈希，同一会话流的请求与响应及同一数据报的各IP分片由同一worker解码
+func packetFlowHash(p gopacket.Packet) uint32 {
+	if nl := p.NetworkLayer(); nl != nil {
+		return uint32(nl.NetworkFlow().FastHash())
+	}
+	return 0
+}
+
 func (s *PcapEventSource) close() {
 	s.closeOnce.Do(func() {
-		if err := s.pool.ReleaseTimeout(time.Second * 3); err != nil {
-			logger.Errorf("event srouce worker pool release timeout %s", err)
+		// 输出通道在全部worker退出后才关闭，避免向已关闭的通道发送
+		if err := s.workers.release(time.Second * 3); err != nil {
+			logger.Errorf("event srouce %s", err)
+			s.workers.wait()
+		}
+		for _, t := range s.tcp {
+			t.flushAll()
 		}
 		close(s.eventCh)
 		close(s.errEventCh)
@@ -192,50 +357,144 @@ func (s *PcapEventSource) close() {
 	})
 }
 
-func unpack(p gopacket.Packet) (*DnsEvent, error) {
-	e := &DnsEvent{}
+func (s *PcapEventSource) newTcpReassembler(iface string) *tcpReassembler {
+	return newTcpReassembler(func(e *DnsEvent) {
+		e.Interface = iface
+		s.emit(e)
+	}, s.emitErr, s.keepRaw)
+}
+
+func (s *PcapEventSource) emit(e *DnsEvent) {
+	s.eventCh <- e
+}
+
+func (s *PcapEventSource) emitErr(err error) {
+	logger.Debugf("unpack packet failed %s", err)
+	s.errEventCh <- &ErrEvent{Time: time.Now(), Reason: errReason(err), Err: err}
+}
+
+// emitPacketErr 数据包级解析错误，附带原始数据包
+func (s *PcapEventSource) emitPacketErr(err error, p gopacket.Packet, linkType layers.LinkType, iface string) {
+	logger.Debugf("unpack packet failed %s", err)
+	e := &ErrEvent{
+		Time:      time.Now(),
+		Reason:    errReason(err),
+		Err:       err,
+		Interface: iface,
+		LinkType:  linkType,
+		Data:      p.Data(),
+	}
+	if md := p.Metadata(); md != nil {
+		e.Time = md.Timestamp
+		e.CaptureInfo = md.CaptureInfo
+	}
+	s.errEventCh <- e
+}
+
+// maxEncapDepth 隧道内层分片重组的最大层数
+const maxEncapDepth = 4
+
+// unpack 解析单个数据包，IP分片未收齐或TCP分段交由流重组处理时，返回的事件为nil
+// 存在VLAN/MPLS/GRE/VXLAN/ERSPAN等封装时取最内层的IP及传输层
+func (s *PcapEventSource) unpack(p gopacket.Packet, iface string) (*DnsEvent, error) {
+	e := &DnsEvent{Interface: iface}
 	if p.Metadata() == nil {
-		return nil, fmt.Errorf("packet metadata missing")
+		return nil, decodeErrorf(ErrReasonMetadataMissing, "packet metadata missing")
 	}
 	e.EventTime = p.Metadata().Timestamp
+	if vlan, ok := ancillaryVlanID(p.Metadata()); ok {
+		e.VlanID = vlan
+	}
+
+	netFlow, ok := e.fromPacketLayers(p)
+	if !ok {
+		// 链路层无法解码（如不支持的链路类型）时gopacket会附带错误层
+		if errLayer := p.ErrorLayer(); errLayer != nil {
+			return nil, decodeErrorf(ErrReasonLinkDecode, "packet decode failed %s", errLayer.Error())
+		}
+		return nil, decodeErrorf(ErrReasonNoIPLayer, "packet missing ip layer")
+	}
 
-	ipLayer := p.Layer(layers.LayerTypeIPv4)
-	if ipLayer != nil {
-		ip, ok := ipLayer.(*layers.IPv4)
-		if !ok {
-			return nil, fmt.Errorf("packet convert ip layer to ipv4 failed")
+	// 重组后的数据包从传输层开始解码，内层仍可能存在分片
+	for i := 0; ; i++ {
+		rp, complete, err := s.defrag.reassemble(p, e.EventTime)
+		if err != nil {
+			return e, err
 		}
-		e.SourceIP = ip.SrcIP.String()
-		e.DestinationIP = ip.DstIP.String()
-	} else {
-		ipLayer := p.Layer(layers.LayerTypeIPv6)
-		if ipLayer == nil {
-			return nil, fmt.Errorf("packet missing ip layer")
+		if !complete {
+			return nil, nil
 		}
-		ip, ok := ipLayer.(*layers.IPv6)
-		if !ok {
-			return e, fmt.Errorf("packet convert ip layer to ipv6 failed")
+		if rp == p {
+			break
+		}
+		if i >= maxEncapDepth {
+			return e, decodeErrorf(ErrReasonFragment, "packet fragments nested deeper than %d", maxEncapDepth)
+		}
+		p = rp
+		if flow, ok := e.fromPacketLayers(p); ok {
+			netFlow = flow
 		}
-		e.SourceIP = ip.SrcIP.String()
-		e.DestinationIP = ip.DstIP.String()
 	}
 
-	udpLayer := p.Layer(layers.LayerTypeUDP)
-	if udpLayer == nil {
-		return e, fmt.Errorf("packet missing udp layer")
-	}
-	udp, ok := udpLayer.(*layers.UDP)
-	if !ok {
-		return e, fmt.Errorf("packet convert udp layer to udp failed")
+	var transport gopacket.Layer
+	for _, l := range p.Layers() {
+		if t := l.LayerType(); t == layers.LayerTypeTCP || t == layers.LayerTypeUDP {
+			transport = l
+		}
 	}
-	e.SourcePort = uint16(udp.SrcPort)
-	e.DestinationPort = uint16(udp.DstPort)
 
-	msg := new(dns.Msg)
-	if err := msg.Unpack(udp.Payload); err != nil {
-		return e, fmt.Errorf("packet unpack to dns msg failed %s", err)
+	switch t := transport.(type) {
+	case *layers.TCP:
+		if !s.dnsPorts.Contains(uint16(t.SrcPort)) && !s.dnsPorts.Contains(uint16(t.DstPort)) {
+			return e, decodeErrorf(ErrReasonNotDnsPort, "packet tcp port %d->%d is not dns", t.SrcPort, t.DstPort)
+		}
+		s.tcp[iface].assemble(netFlow, t, e.EventTime)
+		return nil, nil
+	case *layers.UDP:
+		e.SourcePort = uint16(t.SrcPort)
+		e.DestinationPort = uint16(t.DstPort)
+		e.Transport = TransportUDP
+		if !s.dnsPorts.Contains(e.SourcePort) && !s.dnsPorts.Contains(e.DestinationPort) {
+			if !s.heuristic {
+				return e, decodeErrorf(ErrReasonNotDnsPort, "packet udp port %d->%d is not dns", t.SrcPort, t.DstPort)
+			}
+			e.UnexpectedPort = true
+		}
+		if err := e.unpackMsg(t.Payload); err != nil {
+			return e, err
+		}
+		if s.keepRaw {
+			e.Raw = t.Payload
+		}
+		return e, nil
+	default:
+		return e, decodeErrorf(ErrReasonNoTransportLayer, "packet missing udp or tcp layer")
 	}
+}
 
-	e.FromMsg(msg)
-	return e, nil
+// fromPacketLayers 按最内层IP设置地址，并记录最内层的VLAN ID及VXLAN VNI，无IP层时返回false
+func (e *DnsEvent) fromPacketLayers(p gopacket.Packet) (gopacket.Flow, bool) {
+	var netFlow gopacket.Flow
+	found := false
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.Dot1Q:
+			e.VlanID = l.VLANIdentifier
+		case *layers.ERSPANII:
+			e.VlanID = l.VLANIdentifier
+		case *layers.VXLAN:
+			e.Vni = l.VNI
+		case *layers.IPv4:
+			e.SourceIP = l.SrcIP.String()
+			e.DestinationIP = l.DstIP.String()
+			netFlow = l.NetworkFlow()
+			found = true
+		case *layers.IPv6:
+			e.SourceIP = l.SrcIP.String()
+			e.DestinationIP = l.DstIP.String()
+			netFlow = l.NetworkFlow()
+			found = true
+		}
+	}
+	return netFlow, found
 }
@@ -0,0 +1,165 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
+)
+
+func TestUnpackVxlanInnerFlow(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	outerIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 168, 0, 1), DstIP: net.IPv4(192, 168, 0, 2)}
+	outerUDP := &layers.UDP{SrcPort: 50000, DstPort: 4789}
+	outerUDP.SetNetworkLayerForChecksum(outerIP)
+	innerIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 53)}
+	innerUDP := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	innerUDP.SetNetworkLayerForChecksum(innerIP)
+
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+		outerIP,
+		outerUDP,
+		&layers.VXLAN{ValidIDFlag: true, VNI: 5001},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+		innerIP,
+		innerUDP,
+		gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &PcapEventSource{defrag: newDefragmenter(), dnsPorts: NewPortSet(nil)}
+	e, err := s.unpack(gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default), "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.SourceIP != "10.0.0.1" || e.DestinationIP != "10.0.0.53" || e.DestinationPort != 53 {
+		t.Fatalf("unexpected flow %s:%d->%s:%d", e.SourceIP, e.SourcePort, e.DestinationIP, e.DestinationPort)
+	}
+	if e.Vni != 5001 || e.VlanID != 100 || e.Domain != "example.com." || e.Interface != "eth0" {
+		t.Fatalf("unexpected vni %d vlan %d domain %s interface %s", e.Vni, e.VlanID, e.Domain, e.Interface)
+	}
+}
+
+func TestUnpackHeuristicPort(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	payload, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 53)}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 8053}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := func() gopacket.Packet {
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+
+	s := &PcapEventSource{defrag: newDefragmenter(), dnsPorts: NewPortSet([]uint16{53, 5353})}
+	if _, err := s.unpack(packet(), ""); errReason(err) != ErrReasonNotDnsPort {
+		t.Fatalf("expect not dns port error, got %v", err)
+	}
+
+	s.heuristic = true
+	e, err := s.unpack(packet(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.UnexpectedPort || e.Domain != "example.com." {
+		t.Fatalf("unexpected port flag %v domain %s", e.UnexpectedPort, e.Domain)
+	}
+}
+
+func TestFileSourceFlowOrder(t *testing.T) {
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	server := net.IPv4(10, 0, 0, 53)
+	packet := func(src, dst net.IP, sport, dport layers.UDPPort, m *dns.Msg) []byte {
+		payload, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+		udp := &layers.UDP{SrcPort: sport, DstPort: dport}
+		udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}, ip, udp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	pw := pcapgo.NewWriter(zw)
+	if err := pw.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	// 各客户端的请求后紧跟响应，多个worker并行解码时同一流的事件仍应保持顺序
+	const clientCount = 500
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < clientCount; i++ {
+		client := net.IPv4(10, 1, byte(i/250), byte(i%250+1))
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("host%d.example.com.", i), dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for j, data := range [][]byte{packet(client, server, 40000, 53, q), packet(server, client, 53, 40000, r)} {
+			ci := gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i*2+j) * time.Microsecond), CaptureLength: len(data), Length: len(data)}
+			if err := pw.WritePacket(ci, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	zw.Close()
+	fp := filepath.Join(t.TempDir(), "flows.pcap.gz")
+	if err := os.WriteFile(fp, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewFilesSource(context.Background(), 8, []string{fp}, "", DecodeOptions{DnsPorts: []uint16{53}}, FileOptions{}, func() {})
+	go func() {
+		for range s.ErrEvents() {
+		}
+	}()
+	queried := map[string]bool{}
+	count := 0
+	for e := range s.Events() {
+		count += 1
+		if !e.Response {
+			queried[e.SourceIP] = true
+			continue
+		}
+		if !queried[e.DestinationIP] {
+			t.Fatalf("response to %s decoded before its query", e.DestinationIP)
+		}
+	}
+	if count != clientCount*2 {
+		t.Fatalf("expect %d events, got %d", clientCount*2, count)
+	}
+}
@@ -0,0 +1,24 @@
+package types
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile 按IDNA2008校验标签并解码punycode，不限制下划线等非主机名字符以兼容SRV等服务域名
+var idnaProfile = idna.New(
+	idna.ValidateLabels(true),
+	idna.BidiRule(),
+	idna.CheckHyphens(false),
+)
+
+// normalizeDomain 返回小写域名及解码后的Unicode域名，解码失败时Unicode域名与小写域名一致
+func normalizeDomain(name string) (string, string, error) {
+	normalized := strings.ToLower(name)
+	unicode, err := idnaProfile.ToUnicode(normalized)
+	if err != nil {
+		return normalized, normalized, err
+	}
+	return normalized, unicode, nil
+}
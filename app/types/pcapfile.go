@@ -0,0 +1,264 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+)
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic     = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+)
+
+// 目录递归展开时只收集以下后缀的文件，可叠加压缩后缀
+var (
+	captureFileExts  = []string{".pcap", ".pcapng", ".cap"}
+	compressFileExts = []string{"", ".gz", ".zst", ".xz"}
+)
+
+// expandCaptureFiles 展开通配符及目录，去重后按文件首个数据包时间排序，无法读取首包时间的文件排在最后
+func expandCaptureFiles(patterns []string) []string {
+	seen := map[string]struct{}{}
+	files := []string{}
+	add := func(f string) {
+		if _, ok := seen[f]; ok {
+			return
+		}
+		seen[f] = struct{}{}
+		files = append(files, f)
+	}
+
+	for _, p := range patterns {
+		matches := []string{p}
+		if strings.ContainsAny(p, "*?[") {
+			m, err := filepath.Glob(p)
+			if err != nil {
+				logger.Errorf("expand capture files pattern %s failed %s", p, err)
+				continue
+			}
+			if len(m) == 0 {
+				logger.Warnf("capture files pattern %s matched nothing", p)
+			}
+			matches = m
+		}
+
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				logger.Errorf("stat capture file %s failed %s", m, err)
+				continue
+			}
+			if !info.IsDir() {
+				add(m)
+				continue
+			}
+			err = filepath.WalkDir(m, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.Type().IsRegular() && isCaptureFile(path) {
+					add(path)
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Errorf("walk capture dir %s failed %s", m, err)
+			}
+		}
+	}
+
+	firstTimes := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		t, err := firstPacketTime(f)
+		if err != nil {
+			logger.Warnf("read first packet time of %s failed %s", f, err)
+			continue
+		}
+		firstTimes[f] = t
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		ti, iok := firstTimes[files[i]]
+		tj, jok := firstTimes[files[j]]
+		if iok != jok {
+			return iok
+		}
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return files[i] < files[j]
+	})
+	return files
+}
+
+func isCaptureFile(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	for _, ext := range captureFileExts {
+		for _, c := range compressFileExts {
+			if strings.HasSuffix(name, ext+c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func firstPacketTime(filename string) (time.Time, error) {
+	r, _, closer, err := openCaptureFile(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer closer.Close()
+
+	_, ci, err := r.ReadPacketData()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ci.Timestamp, nil
+}
+
+// openCaptureFile 按文件头魔数识别gzip/zstd/xz压缩及pcap/pcapng格式，返回纯Go读取器
+func openCaptureFile(filename string) (gopacket.PacketDataSource, layers.LinkType, io.Closer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	closers := multiCloser{f}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(6)
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			closers.Close()
+			return nil, 0, nil, fmt.Errorf("open gzip reader failed %s", err)
+		}
+		r = zr
+		closers = append(multiCloser{zr}, closers...)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			closers.Close()
+			return nil, 0, nil, fmt.Errorf("open zstd reader failed %s", err)
+		}
+		r = zr
+		closers = append(multiCloser{zr.IOReadCloser()}, closers...)
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			closers.Close()
+			return nil, 0, nil, fmt.Errorf("open xz reader failed %s", err)
+		}
+		r = xr
+	}
+
+	pr := bufio.NewReader(r)
+	head, _ := pr.Peek(4)
+	if bytes.Equal(head, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(pr, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			closers.Close()
+			return nil, 0, nil, fmt.Errorf("open pcapng reader failed %s", err)
+		}
+		return ng, ng.LinkType(), closers, nil
+	}
+
+	pcapReader, err := pcapgo.NewReader(pr)
+	if err != nil {
+		closers.Close()
+		return nil, 0, nil, fmt.Errorf("open pcap reader failed %s", err)
+	}
+	return pcapReader, pcapReader.LinkType(), closers, nil
+}
+
+func isCompressedFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	return bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic) || bytes.HasPrefix(magic, xzMagic), nil
+}
+
+// bpfPacketDataSource 纯Go读取器不支持内核过滤，逐包匹配bpf过滤器
+type bpfPacketDataSource struct {
+	source gopacket.PacketDataSource
+	filter *pcap.BPF
+}
+
+func (s *bpfPacketDataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.source.ReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+		if s.filter == nil || s.filter.Matches(ci, data) {
+			return data, ci, nil
+		}
+	}
+}
+
+// readErrSource 记录读取中除EOF外的错误（如文件截断、解压失败），并以EOF结束读取，
+// PacketSource遇到此类错误时仅结束读取或不断重试，不会返回给调用方
+type readErrSource struct {
+	source gopacket.PacketDataSource
+	mu     sync.Mutex
+	err    error
+}
+
+func (s *readErrSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.source.ReadPacketData()
+	if err != nil && err != io.EOF {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = fmt.Errorf("read packet failed %s", err)
+		}
+		s.mu.Unlock()
+		return data, ci, io.EOF
+	}
+	return data, ci, err
+}
+
+func (s *readErrSource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestExpandCaptureFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)
+
+	writePcap := func(name string, ts time.Time, wrap func(io.Writer) io.WriteCloser) string {
+		fp := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var w io.Writer = f
+		if wrap != nil {
+			wc := wrap(f)
+			defer wc.Close()
+			w = wc
+		}
+		pw := pcapgo.NewWriter(w)
+		if err := pw.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 60)
+		if err := pw.WritePacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}, data); err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+
+	// 文件名顺序与首包时间顺序相反
+	zst := writePcap("0601/a.pcap.zst", base.Add(time.Hour*2), func(w io.Writer) io.WriteCloser {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zw
+	})
+	gz := writePcap("0601/b.pcap.gz", base.Add(time.Hour), func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	})
+	plain := writePcap("0602/c.pcap", base, nil)
+	writePcap("0602/notes.txt", base, nil)
+
+	files := expandCaptureFiles([]string{dir, filepath.Join(dir, "0601", "*.gz")})
+	if len(files) != 3 || files[0] != plain || files[1] != gz || files[2] != zst {
+		t.Fatalf("unexpected files order %v", files)
+	}
+
+	for _, f := range files[1:] {
+		compressed, err := isCompressedFile(f)
+		if err != nil || !compressed {
+			t.Fatalf("expect %s compressed, got %v %v", f, compressed, err)
+		}
+	}
+}
+
+func TestOpenXzCaptureFile(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw := pcapgo.NewWriter(xw)
+	if err := pw.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		rand.Read(data)
+		if err := pw.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(b []byte) (int, error) {
+		fp := filepath.Join(dir, "a.pcap.xz")
+		if err := os.WriteFile(fp, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, _, closer, err := openCaptureFile(fp)
+		if err != nil {
+			return 0, err
+		}
+		defer closer.Close()
+		source := &readErrSource{source: r}
+		n := 0
+		for {
+			if _, _, err := source.ReadPacketData(); err != nil {
+				return n, source.Err()
+			}
+			n += 1
+		}
+	}
+
+	if n, err := read(buf.Bytes()); n != 100 || err != nil {
+		t.Fatalf("expect 100 packets without error, got %d %v", n, err)
+	}
+	// 截断的压缩文件不应被当作正常结束
+	if n, err := read(buf.Bytes()[:buf.Len()/2]); n >= 100 || err == nil {
+		t.Fatalf("expect read error of truncated xz file, got %d packets", n)
+	}
+}
@@ -0,0 +1,122 @@
+package types
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RdataFields 按记录类型拆分的RDATA字段，不适用于当前记录类型的字段为零值
+type RdataFields struct {
+	Address string `json:"Address" pb:"1"` // A/AAAA
+	Target  string `json:"Target" pb:"2"`  // CNAME/DNAME/NS/PTR目标、MX交换器、SRV/SVCB/HTTPS目标
+
+	Priority uint16 `json:"Priority" pb:"3"` // MX preference、SRV/SVCB/HTTPS priority
+	Weight   uint16 `json:"Weight" pb:"4"`   // SRV
+	Port     uint16 `json:"Port" pb:"5"`     // SRV
+
+	// SOA
+	Mname   string `json:"Mname" pb:"6"`
+	Rname   string `json:"Rname" pb:"7"`
+	Serial  uint32 `json:"Serial" pb:"8"`
+	Refresh uint32 `json:"Refresh" pb:"9"`
+	Retry   uint32 `json:"Retry" pb:"10"`
+	Expire  uint32 `json:"Expire" pb:"11"`
+	Minimum uint32 `json:"Minimum" pb:"12"`
+
+	Txt []string `json:"Txt" pb:"13"` // TXT/SPF字符串片段
+
+	// DNSKEY/DS/RRSIG
+	Flags       uint16 `json:"Flags" pb:"14"`
+	Protocol    uint8  `json:"Protocol" pb:"15"`
+	Algorithm   uint8  `json:"Algorithm" pb:"16"`
+	PublicKey   string `json:"PublicKey" pb:"17"` // base64编码
+	KeyTag      uint16 `json:"KeyTag" pb:"18"`
+	DigestType  uint8  `json:"DigestType" pb:"19"`
+	Digest      string `json:"Digest" pb:"20"` // 十六进制编码
+	TypeCovered string `json:"TypeCovered" pb:"21"`
+	Labels      uint8  `json:"Labels" pb:"22"`
+	OrigTtl     uint32 `json:"OrigTtl" pb:"23"`
+	Expiration  uint32 `json:"Expiration" pb:"24"` // unix时间戳
+	Inception   uint32 `json:"Inception" pb:"25"`  // unix时间戳
+	SignerName  string `json:"SignerName" pb:"26"`
+	Signature   string `json:"Signature" pb:"27"` // base64编码
+
+	SvcParams map[string]string `json:"SvcParams" pb:"28"` // SVCB/HTTPS参数，键为参数名
+}
+
+func newRdataFields(mrr dns.RR) RdataFields {
+	f := RdataFields{
+		Txt:       []string{},
+		SvcParams: map[string]string{},
+	}
+
+	switch r := mrr.(type) {
+	case *dns.A:
+		f.Address = r.A.String()
+	case *dns.AAAA:
+		f.Address = r.AAAA.String()
+	case *dns.CNAME:
+		f.Target = r.Target
+	case *dns.DNAME:
+		f.Target = r.Target
+	case *dns.NS:
+		f.Target = r.Ns
+	case *dns.PTR:
+		f.Target = r.Ptr
+	case *dns.MX:
+		f.Target = r.Mx
+		f.Priority = r.Preference
+	case *dns.SRV:
+		f.Target = r.Target
+		f.Priority = r.Priority
+		f.Weight = r.Weight
+		f.Port = r.Port
+	case *dns.SOA:
+		f.Mname = r.Ns
+		f.Rname = r.Mbox
+		f.Serial = r.Serial
+		f.Refresh = r.Refresh
+		f.Retry = r.Retry
+		f.Expire = r.Expire
+		f.Minimum = r.Minttl
+	case *dns.TXT:
+		f.Txt = append(f.Txt, r.Txt...)
+	case *dns.SPF:
+		f.Txt = append(f.Txt, r.Txt...)
+	case *dns.DNSKEY:
+		f.Flags = r.Flags
+		f.Protocol = r.Protocol
+		f.Algorithm = r.Algorithm
+		f.PublicKey = r.PublicKey
+		f.KeyTag = r.KeyTag()
+	case *dns.DS:
+		f.KeyTag = r.KeyTag
+		f.Algorithm = r.Algorithm
+		f.DigestType = r.DigestType
+		f.Digest = strings.ToLower(r.Digest)
+	case *dns.RRSIG:
+		f.TypeCovered = dns.TypeToString[r.TypeCovered]
+		f.Algorithm = r.Algorithm
+		f.Labels = r.Labels
+		f.OrigTtl = r.OrigTtl
+		f.Expiration = r.Expiration
+		f.Inception = r.Inception
+		f.KeyTag = r.KeyTag
+		f.SignerName = r.SignerName
+		f.Signature = r.Signature
+	case *dns.SVCB:
+		f.fromSvcb(r)
+	case *dns.HTTPS:
+		f.fromSvcb(&r.SVCB)
+	}
+	return f
+}
+
+func (f *RdataFields) fromSvcb(r *dns.SVCB) {
+	f.Target = r.Target
+	f.Priority = r.Priority
+	for _, kv := range r.Value {
+		f.SvcParams[kv.Key().String()] = kv.String()
+	}
+}
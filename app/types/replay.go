@@ -0,0 +1,62 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ReplaySpeedMax = "max"
+
+// ParseReplaySpeed 解析回放倍速，max或空表示不限速，返回0
+func ParseReplaySpeed(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == ReplaySpeedMax {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed %s, should be max or like 1x, 10x, 0.5x", s)
+	}
+	return speed, nil
+}
+
+// replayClock 按数据包捕获时间间隔回放，首个数据包对应回放开始的墙上时间
+type replayClock struct {
+	speed       float64
+	firstPacket time.Time
+	wallStart   time.Time
+}
+
+func newReplayClock(speed float64) *replayClock {
+	return &replayClock{speed: speed}
+}
+
+// wait 阻塞到数据包应被处理的时间，收到退出信号时返回false
+func (c *replayClock) wait(ctx context.Context, t time.Time) bool {
+	if c == nil || c.speed <= 0 {
+		return true
+	}
+	if c.firstPacket.IsZero() {
+		c.firstPacket = t
+		c.wallStart = time.Now()
+		return true
+	}
+
+	due := c.wallStart.Add(time.Duration(float64(t.Sub(c.firstPacket)) / c.speed))
+	d := time.Until(due)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReplayClock(t *testing.T) {
+	for s, want := range map[string]float64{"max": 0, "": 0, "1x": 1, "10X": 10, "0.5x": 0.5} {
+		speed, err := ParseReplaySpeed(s)
+		if err != nil || speed != want {
+			t.Fatalf("parse %s expect %v, got %v %v", s, want, speed, err)
+		}
+	}
+	if _, err := ParseReplaySpeed("fast"); err == nil {
+		t.Fatal("expect error for invalid speed")
+	}
+
+	// 100倍速下间隔2秒的数据包约等待20毫秒
+	c := newReplayClock(100)
+	base := time.Now()
+	begin := time.Now()
+	c.wait(context.Background(), base)
+	c.wait(context.Background(), base.Add(time.Second*2))
+	if d := time.Since(begin); d < time.Millisecond*20 || d > time.Second {
+		t.Fatalf("unexpected replay wait %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if c.wait(ctx, base.Add(time.Hour)) {
+		t.Fatal("expect wait interrupted by context")
+	}
+}
@@ -0,0 +1,492 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SchemaVersion DnsEvent结构版本，字段增删或类型变更时递增，并通过-schema重新生成scripts/dnsevent.sql及app/types/dnsevent.proto
+const SchemaVersion uint32 = 8
+
+const (
+	schemaProtoPackage = "dnscap"
+	schemaProtoFile    = "dnsevent.proto"
+	csvTimeLayout      = "2006-01-02 15:04:05.000000"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// DnsEvent结构体即为唯一的结构定义，json标签为各格式统一的字段名，pb标签为protobuf字段编号，
+// JSON/CSV/duckdb DDL/protobuf映射均在初始化时据此生成
+var (
+	dnsEventFields = schemaFieldsOf(reflect.TypeOf(DnsEvent{}))
+	dnsEventProto  = mustBuildProtoFile()
+)
+
+// schemaFieldsCache 嵌套结构字段缓存，避免逐事件重复解析标签
+var schemaFieldsCache sync.Map
+
+func cachedSchemaFields(t reflect.Type) []schemaField {
+	if fields, ok := schemaFieldsCache.Load(t); ok {
+		return fields.([]schemaField)
+	}
+	fields := schemaFieldsOf(t)
+	schemaFieldsCache.Store(t, fields)
+	return fields
+}
+
+type schemaField struct {
+	name   string
+	number int32
+	index  int
+	typ    reflect.Type
+}
+
+func schemaFieldsOf(t reflect.Type) []schemaField {
+	fields := []schemaField{}
+	numbers := map[int32]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("json")
+		if name == "" || name == "-" {
+			panic(fmt.Sprintf("schema field %s.%s missing json tag", t.Name(), f.Name))
+		}
+		number, err := strconv.ParseInt(f.Tag.Get("pb"), 10, 32)
+		if err != nil || number <= 0 {
+			panic(fmt.Sprintf("schema field %s.%s invalid pb tag %q", t.Name(), f.Name, f.Tag.Get("pb")))
+		}
+		if exist, ok := numbers[int32(number)]; ok {
+			panic(fmt.Sprintf("schema field %s.%s pb number %d conflict with %s", t.Name(), f.Name, number, exist))
+		}
+		numbers[int32(number)] = f.Name
+
+		fields = append(fields, schemaField{
+			name:   name,
+			number: int32(number),
+			index:  i,
+			typ:    f.Type,
+		})
+	}
+	return fields
+}
+
+func isBytes(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+func (e *DnsEvent) stamped() reflect.Value {
+	c := *e
+	c.SchemaVersion = SchemaVersion
+	return reflect.ValueOf(c)
+}
+
+// JSON映射
+
+func (e *DnsEvent) JsonString() string {
+	c := *e
+	c.SchemaVersion = SchemaVersion
+	b, _ := json.Marshal(&c)
+	return string(b)
+}
+
+// CSV映射，各列按duckdb字面量格式输出，可直接COPY至DnsEventDDL建立的表中
+
+func CsvHeader() []string {
+	header := make([]string, 0, len(dnsEventFields))
+	for _, f := range dnsEventFields {
+		header = append(header, f.name)
+	}
+	return header
+}
+
+func (e *DnsEvent) CsvStrings() []string {
+	v := e.stamped()
+	ss := make([]string, 0, len(dnsEventFields))
+	for _, f := range dnsEventFields {
+		ss = append(ss, csvValue(v.Field(f.index), false))
+	}
+	return ss
+}
+
+// csvValue nested为true时值位于列表、结构或MAP内，字符串按需加引号转义
+func csvValue(v reflect.Value, nested bool) string {
+	t := v.Type()
+	switch {
+	case t == timeType:
+		return csvString(v.Interface().(time.Time).Format(csvTimeLayout), nested)
+	case isBytes(t):
+		return csvString(blobLiteral(v.Bytes()), nested)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return csvString(v.String(), nested)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', 2, 64)
+	case reflect.Slice:
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, csvValue(v.Index(i), true))
+		}
+		return `[` + strings.Join(items, `, `) + `]`
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		items := make([]string, 0, len(keys))
+		for _, k := range keys {
+			items = append(items, csvValue(k, true)+`=`+csvValue(v.MapIndex(k), true))
+		}
+		return `{` + strings.Join(items, `, `) + `}`
+	case reflect.Struct:
+		fields := cachedSchemaFields(t)
+		items := make([]string, 0, len(fields))
+		for _, f := range fields {
+			items = append(items, `'`+f.name+`': `+csvValue(v.Field(f.index), true))
+		}
+		return `{` + strings.Join(items, `, `) + `}`
+	}
+	panic(fmt.Sprintf("unsupported schema type %s", t))
+}
+
+// csvString 嵌套值中的空串、NULL及含分隔符、引号或首尾空白的字符串需加引号，优先选用字符串中未出现的引号，
+// 两种引号均出现时以反斜杠转义；随程序打包的duckdb 1.1不做反斜杠反转义且保留列表元素的引号，此类值需较新版本导入
+func csvString(s string, nested bool) string {
+	if !nested {
+		return s
+	}
+	if s != "" && !strings.EqualFold(s, "null") && !strings.ContainsAny(s, `,'"[]{}`) && strings.TrimSpace(s) == s {
+		return s
+	}
+	switch {
+	case !strings.Contains(s, `'`):
+		return `'` + s + `'`
+	case !strings.Contains(s, `"`):
+		return `"` + s + `"`
+	}
+	return `'` + csvEscaper.Replace(s) + `'`
+}
+
+var csvEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// blobLiteral duckdb BLOB字面量，逐字节以\xNN表示
+func blobLiteral(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b) * 4)
+	for _, c := range b {
+		fmt.Fprintf(&sb, `\x%02X`, c)
+	}
+	return sb.String()
+}
+
+// duckdb映射
+
+// DnsEventDDL 生成duckdb建表语句
+func DnsEventDDL(table string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- schema version %d\n", SchemaVersion)
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (\n", table)
+	for i, f := range dnsEventFields {
+		fmt.Fprintf(&b, "    %s %s", f.name, duckdbType(f.typ, "    "))
+		if i < len(dnsEventFields)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n")
+	return b.String()
+}
+
+func duckdbType(t reflect.Type, indent string) string {
+	switch {
+	case t == timeType:
+		return "DATETIME"
+	case isBytes(t):
+		return "BLOB"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "VARCHAR"
+	case reflect.Bool:
+		return "BOOLEAN"
+	case reflect.Uint8:
+		return "UTINYINT"
+	case reflect.Uint16:
+		return "USMALLINT"
+	case reflect.Uint32:
+		return "UINTEGER"
+	case reflect.Int64:
+		return "BIGINT"
+	case reflect.Float64:
+		return "DOUBLE"
+	case reflect.Slice:
+		return duckdbType(t.Elem(), indent) + "[]"
+	case reflect.Map:
+		return "MAP(" + duckdbType(t.Key(), indent) + ", " + duckdbType(t.Elem(), indent) + ")"
+	case reflect.Struct:
+		fields := schemaFieldsOf(t)
+		items := make([]string, 0, len(fields))
+		for _, f := range fields {
+			items = append(items, indent+"    "+f.name+" "+duckdbType(f.typ, indent+"    "))
+		}
+		return "STRUCT(\n" + strings.Join(items, ",\n") + "\n" + indent + ")"
+	}
+	panic(fmt.Sprintf("unsupported schema type %s", t))
+}
+
+// DbValues 按DDL列顺序返回duckdb appender行数据
+func (e *DnsEvent) DbValues() []driver.Value {
+	v := e.stamped()
+	values := make([]driver.Value, 0, len(dnsEventFields))
+	for _, f := range dnsEventFields {
+		values = append(values, dbValue(v.Field(f.index)))
+	}
+	return values
+}
+
+// dbValue 嵌套结构按字段名转为map[string]any，MAP转为duckdb.Map，驱动不支持直接追加含MAP的结构体
+func dbValue(v reflect.Value) any {
+	t := v.Type()
+	if t == timeType || isBytes(t) {
+		return v.Interface()
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		items := make([]any, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, dbValue(v.Index(i)))
+		}
+		return items
+	case reflect.Map:
+		m := make(duckdb.Map, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[dbValue(iter.Key())] = dbValue(iter.Value())
+		}
+		return m
+	case reflect.Struct:
+		fields := cachedSchemaFields(t)
+		m := make(map[string]any, len(fields))
+		for _, f := range fields {
+			m[f.name] = dbValue(v.Field(f.index))
+		}
+		return m
+	}
+	return v.Interface()
+}
+
+// protobuf映射，消息描述在运行时由结构体生成，使用dynamicpb编码，无需protoc
+
+func mustBuildProtoFile() protoreflect.FileDescriptor {
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String(schemaProtoFile),
+		Package:    proto.String(schemaProtoPackage),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{timestamppb.File_google_protobuf_timestamp_proto.Path()},
+	}
+
+	messages := map[string]*descriptorpb.DescriptorProto{}
+	var addMessage func(t reflect.Type)
+	addMessage = func(t reflect.Type) {
+		if _, ok := messages[t.Name()]; ok {
+			return
+		}
+		m := &descriptorpb.DescriptorProto{Name: proto.String(t.Name())}
+		messages[t.Name()] = m
+
+		for _, f := range schemaFieldsOf(t) {
+			ft := f.typ
+			label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+			if ft.Kind() == reflect.Slice && !isBytes(ft) {
+				label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+				ft = ft.Elem()
+			}
+
+			fd := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(f.name),
+				JsonName: proto.String(f.name),
+				Number:   proto.Int32(f.number),
+				Label:    label.Enum(),
+			}
+			switch {
+			case ft.Kind() == reflect.Map:
+				// proto3 map字段即嵌套MapEntry消息的repeated字段
+				entry := &descriptorpb.DescriptorProto{
+					Name:    proto.String(f.name + "Entry"),
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("key"), JsonName: proto.String("key"), Number: proto.Int32(1), Label: label.Enum(), Type: protoScalarType(ft.Key()).Enum()},
+						{Name: proto.String("value"), JsonName: proto.String("value"), Number: proto.Int32(2), Label: label.Enum(), Type: protoScalarType(ft.Elem()).Enum()},
+					},
+				}
+				m.NestedType = append(m.NestedType, entry)
+				fd.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				fd.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fd.TypeName = proto.String("." + schemaProtoPackage + "." + t.Name() + "." + entry.GetName())
+			case ft == timeType:
+				fd.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fd.TypeName = proto.String("." + string((&timestamppb.Timestamp{}).ProtoReflect().Descriptor().FullName()))
+			case ft.Kind() == reflect.Struct:
+				addMessage(ft)
+				fd.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fd.TypeName = proto.String("." + schemaProtoPackage + "." + ft.Name())
+			default:
+				fd.Type = protoScalarType(ft).Enum()
+			}
+			m.Field = append(m.Field, fd)
+		}
+	}
+	addMessage(reflect.TypeOf(DnsEvent{}))
+
+	names := make([]string, 0, len(messages))
+	for name := range messages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fdp.MessageType = append(fdp.MessageType, messages[name])
+	}
+
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(fmt.Sprintf("build dnsevent proto descriptor failed %s", err))
+	}
+	return fd
+}
+
+func protoScalarType(t reflect.Type) descriptorpb.FieldDescriptorProto_Type {
+	if isBytes(t) {
+		return descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return descriptorpb.FieldDescriptorProto_TYPE_STRING
+	case reflect.Bool:
+		return descriptorpb.FieldDescriptorProto_TYPE_BOOL
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return descriptorpb.FieldDescriptorProto_TYPE_UINT32
+	case reflect.Int64:
+		return descriptorpb.FieldDescriptorProto_TYPE_INT64
+	case reflect.Float64:
+		return descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+	}
+	panic(fmt.Sprintf("unsupported schema type %s", t))
+}
+
+// ProtoMessage 转换为protobuf消息，消息描述见app/types/dnsevent.proto
+func (e *DnsEvent) ProtoMessage() proto.Message {
+	m := dynamicpb.NewMessage(dnsEventProto.Messages().ByName("DnsEvent"))
+	fillProtoMessage(m, e.stamped())
+	return m
+}
+
+func fillProtoMessage(m protoreflect.Message, v reflect.Value) {
+	fds := m.Descriptor().Fields()
+	for _, f := range cachedSchemaFields(v.Type()) {
+		fd := fds.ByNumber(protoreflect.FieldNumber(f.number))
+		fv := v.Field(f.index)
+		if fd.IsMap() {
+			mm := m.Mutable(fd).Map()
+			iter := fv.MapRange()
+			for iter.Next() {
+				k := protoValue(nil, fd.MapKey(), iter.Key())
+				mm.Set(k.MapKey(), protoValue(nil, fd.MapValue(), iter.Value()))
+			}
+			continue
+		}
+		if fd.IsList() {
+			l := m.Mutable(fd).List()
+			for i := 0; i < fv.Len(); i++ {
+				l.Append(protoValue(l.NewElement, fd, fv.Index(i)))
+			}
+			continue
+		}
+		m.Set(fd, protoValue(func() protoreflect.Value { return m.NewField(fd) }, fd, fv))
+	}
+}
+
+func protoValue(newElement func() protoreflect.Value, fd protoreflect.FieldDescriptor, v reflect.Value) protoreflect.Value {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		if v.Type() == timeType {
+			return protoreflect.ValueOfMessage(timestamppb.New(v.Interface().(time.Time)).ProtoReflect())
+		}
+		elem := newElement()
+		fillProtoMessage(elem.Message(), v)
+		return elem
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(v.String())
+	case protoreflect.BoolKind:
+		return protoreflect.ValueOfBool(v.Bool())
+	case protoreflect.Uint32Kind:
+		return protoreflect.ValueOfUint32(uint32(v.Uint()))
+	case protoreflect.Int64Kind:
+		return protoreflect.ValueOfInt64(v.Int())
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(v.Float())
+	case protoreflect.BytesKind:
+		return protoreflect.ValueOfBytes(v.Bytes())
+	}
+	panic(fmt.Sprintf("unsupported proto kind %s", fd.Kind()))
+}
+
+// ProtoSchema 生成与运行时消息描述一致的.proto文件内容
+func ProtoSchema() string {
+	var b strings.Builder
+	b.WriteString("// Code generated by dnscap-tool -schema proto. DO NOT EDIT.\n")
+	fmt.Fprintf(&b, "// schema version %d\n\n", SchemaVersion)
+	b.WriteString("syntax = \"proto3\";\n\n")
+	fmt.Fprintf(&b, "package %s;\n\n", schemaProtoPackage)
+	imports := dnsEventProto.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		fmt.Fprintf(&b, "import %q;\n", imports.Get(i).Path())
+	}
+
+	msgs := dnsEventProto.Messages()
+	for i := 0; i < msgs.Len(); i++ {
+		md := msgs.Get(i)
+		fmt.Fprintf(&b, "\nmessage %s {\n", md.Name())
+		fds := md.Fields()
+		for j := 0; j < fds.Len(); j++ {
+			fd := fds.Get(j)
+			typ := fd.Kind().String()
+			if fd.Kind() == protoreflect.MessageKind {
+				typ = string(fd.Message().FullName())
+				if fd.Message().ParentFile() == dnsEventProto {
+					typ = string(fd.Message().Name())
+				}
+			}
+			if fd.IsMap() {
+				typ = fmt.Sprintf("map<%s, %s>", fd.MapKey().Kind(), fd.MapValue().Kind())
+			} else if fd.IsList() {
+				typ = "repeated " + typ
+			}
+			fmt.Fprintf(&b, "  %s %s = %d;\n", typ, fd.Name(), fd.Number())
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
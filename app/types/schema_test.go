@@ -0,0 +1,182 @@
+package types
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestSchemaFilesUpToDate(t *testing.T) {
+	files := map[string]string{
+		"../../scripts/dnsevent.sql": DnsEventDDL("dnsevent"),
+		"dnsevent.proto":             ProtoSchema(),
+	}
+	for f, generated := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != generated {
+			t.Fatalf("%s out of date, regenerate by dnscap-tool -schema ddl|proto", f)
+		}
+	}
+}
+
+func TestProtoMessage(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeMX)
+	m.Response = true
+	rr, err := dns.NewRR("example.com. 60 IN MX 10 mail.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answer = append(m.Answer, rr)
+
+	e := &DnsEvent{EventTime: time.Unix(1718790000, 0), SourcePort: 53}
+	e.FromMsg(m)
+	b, err := proto.Marshal(e.ProtoMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := dnsEventProto.Messages().ByName("DnsEvent")
+	decoded := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	fields := md.Fields()
+	if decoded.Get(fields.ByName("SchemaVersion")).Uint() != uint64(SchemaVersion) || decoded.Get(fields.ByName("Domain")).String() != "example.com." || decoded.Get(fields.ByName("SourcePort")).Uint() != 53 {
+		t.Fatalf("unexpected decoded message %v", decoded)
+	}
+	answer := decoded.Get(fields.ByName("Answer")).List()
+	if answer.Len() != 1 {
+		t.Fatalf("unexpected answer count %d", answer.Len())
+	}
+	rrMsg := answer.Get(0).Message()
+	rdata := rrMsg.Get(rrMsg.Descriptor().Fields().ByName("RdataFields")).Message()
+	if rdata.Get(rdata.Descriptor().Fields().ByName("Priority")).Uint() != 10 {
+		t.Fatalf("unexpected rdata %v", rdata)
+	}
+}
+
+func TestCsvCopyRoundTrip(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeHTTPS)
+	m.Response = true
+	for _, s := range []string{
+		`www.example.com. 60 IN HTTPS 1 . alpn="h2,h3" port=8443`,
+		`www.example.com. 60 IN TXT "v=spf1" "-all"`,
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	raw, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &DnsEvent{EventTime: time.Date(2024, 6, 19, 0, 0, 0, 123456000, time.UTC), SourcePort: 53, Raw: raw}
+	e.FromMsg(m)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "dnsevent.csv")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := csv.NewWriter(f)
+	w.Write(CsvHeader())
+	w.Write(e.CsvStrings())
+	w.Flush()
+	f.Close()
+
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connector.Close()
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	for _, table := range []string{"from_csv", "from_appender"} {
+		if _, err := db.Exec(DnsEventDDL(table)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`COPY from_csv FROM '` + filename + `' (HEADER)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// 与dnsdb相同经appender写入，两种方式写入的数据应一致
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appender, err := duckdb.NewAppenderFromConn(conn, "", "from_appender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appender.AppendRow(e.DbValues()...); err != nil {
+		t.Fatal(err)
+	}
+	if err := appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	var (
+		version uint32
+		alpn    string
+		txt     string
+		rdata   string
+		rawLen  int
+		equal   bool
+		copied  [2]any
+		direct  [2]any
+	)
+	// appender按go map遍历顺序写入MAP条目，嵌套的MAP在Go中按键比较
+	row := db.QueryRow(`SELECT c.SchemaVersion, map_extract(c.Answer[1].RdataFields.SvcParams, 'alpn')[1], c.Answer[2].RdataFields.Txt[2], c.Answer[1].Rdata, octet_length(c.Raw),
+		c.Raw = a.Raw AND c.EventTime = a.EventTime AND c.Domain = a.Domain, c.Answer, c.Authority, a.Answer, a.Authority
+		FROM from_csv c, from_appender a`)
+	if err := row.Scan(&version, &alpn, &txt, &rdata, &rawLen, &equal, &copied[0], &copied[1], &direct[0], &direct[1]); err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion || alpn != "h2,h3" || txt != "-all" || rdata != e.Answer[0].Rdata || rawLen != len(raw) {
+		t.Fatalf("unexpected copied row version %d alpn %q txt %q rdata %q raw length %d", version, alpn, txt, rdata, rawLen)
+	}
+	if !equal || !reflect.DeepEqual(copied, direct) {
+		t.Fatal("csv copied row differs from appended row")
+	}
+}
+
+func TestCsvNestedString(t *testing.T) {
+	cases := map[string]string{
+		"www.example.com.":     "www.example.com.",
+		"":                     "''",
+		"NULL":                 "'NULL'",
+		" lead":                "' lead'",
+		`alpn="h2,h3"`:         `'alpn="h2,h3"'`,
+		"it's":                 `"it's"`,
+		`"it's"`:               `'"it\'s"'`,
+		`say "it's" \ escaped`: `'say "it\'s" \\ escaped'`,
+	}
+	for s, expect := range cases {
+		if got := csvString(s, true); got != expect {
+			t.Fatalf("csv string %q expect %s, got %s", s, expect, got)
+		}
+	}
+	if got := csvString("a,b", false); got != "a,b" {
+		t.Fatalf("top level string should not be quoted, got %s", got)
+	}
+}
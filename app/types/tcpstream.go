@@ -0,0 +1,183 @@
+package types
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const (
+	tcpStreamTimeout       = time.Minute * 2
+	tcpFlushInterval       = time.Second * 30
+	tcpMaxBufferedPages    = 100000
+	tcpMaxPagesPerStream   = 1000
+	tcpMessageLengthPrefix = 2
+)
+
+// tcpReassembler 将DNS端口的TCP分段重组为DNS消息流，Assembler本身非并发安全，所有调用均需持锁
+type tcpReassembler struct {
+	mu            sync.Mutex
+	assembler     *tcpassembly.Assembler
+	lastFlushTime time.Time
+}
+
+func newTcpReassembler(emit func(*DnsEvent), emitErr func(error), keepRaw bool) *tcpReassembler {
+	pool := tcpassembly.NewStreamPool(&dnsStreamFactory{
+		emit:    emit,
+		emitErr: emitErr,
+		keepRaw: keepRaw,
+	})
+	assembler := tcpassembly.NewAssembler(pool)
+	assembler.MaxBufferedPagesTotal = tcpMaxBufferedPages
+	assembler.MaxBufferedPagesPerConnection = tcpMaxPagesPerStream
+
+	return &tcpReassembler{
+		assembler: assembler,
+	}
+}
+
+func (r *tcpReassembler) assemble(netFlow gopacket.Flow, tcp *layers.TCP, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.assembler.AssembleWithTimestamp(netFlow, tcp, t)
+}
+
+// flushIfNeed 以数据包时间为基准定期清理超时的流，离线文件与实时抓包行为一致
+func (r *tcpReassembler) flushIfNeed(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if (r.lastFlushTime == time.Time{}) {
+		r.lastFlushTime = t
+		return
+	}
+
+	if t.Sub(r.lastFlushTime) < tcpFlushInterval {
+		return
+	}
+
+	r.assembler.FlushOlderThan(t.Add(-tcpStreamTimeout))
+	r.lastFlushTime = t
+}
+
+func (r *tcpReassembler) flushAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.assembler.FlushAll()
+}
+
+type dnsStreamFactory struct {
+	emit    func(*DnsEvent)
+	emitErr func(error)
+	keepRaw bool
+}
+
+func (f *dnsStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	src, dst := tcpFlow.Endpoints()
+	srcPort, _ := strconv.Atoi(src.String())
+	dstPort, _ := strconv.Atoi(dst.String())
+
+	return &dnsStream{
+		srcIP:   netFlow.Src().String(),
+		dstIP:   netFlow.Dst().String(),
+		srcPort: uint16(srcPort),
+		dstPort: uint16(dstPort),
+		emit:    f.emit,
+		emitErr: f.emitErr,
+		keepRaw: f.keepRaw,
+	}
+}
+
+// dnsStream 单向TCP流，按RFC 1035 4.2.2的2字节长度前缀切分DNS消息
+type dnsStream struct {
+	srcIP    string
+	dstIP    string
+	srcPort  uint16
+	dstPort  uint16
+	buf      []byte
+	desynced bool // 出现缺口后消息边界已丢失
+	emit     func(*DnsEvent)
+	emitErr  func(error)
+	keepRaw  bool
+}
+
+func (s *dnsStream) Reassembled(rs []tcpassembly.Reassembly) {
+	for _, r := range rs {
+		if r.Skip != 0 {
+			// 未捕获到流起始（Skip为-1，如抓包开始时连接已建立）或存在丢失的分段，无法再确定消息边界，
+			// 丢弃已缓存数据及该流的后续数据
+			if !s.desynced {
+				if r.Skip < 0 {
+					s.emitErr(decodeErrorf(ErrReasonTcpStream, "tcp stream %s:%d->%s:%d start not captured", s.srcIP, s.srcPort, s.dstIP, s.dstPort))
+				} else {
+					s.emitErr(decodeErrorf(ErrReasonTcpStream, "tcp stream %s:%d->%s:%d lost %d bytes", s.srcIP, s.srcPort, s.dstIP, s.dstPort, r.Skip))
+				}
+			}
+			s.desynced = true
+			s.buf = nil
+			continue
+		}
+		if s.desynced {
+			continue
+		}
+		s.buf = append(s.buf, r.Bytes...)
+		s.split(r.Seen)
+	}
+}
+
+func (s *dnsStream) ReassemblyComplete() {
+	s.buf = nil
+}
+
+func (s *dnsStream) split(t time.Time) {
+	for {
+		payload, rest, ok := splitTcpMessage(s.buf)
+		if !ok {
+			break
+		}
+
+		e := &DnsEvent{
+			EventTime:       t,
+			SourceIP:        s.srcIP,
+			SourcePort:      s.srcPort,
+			DestinationIP:   s.dstIP,
+			DestinationPort: s.dstPort,
+			Transport:       TransportTCP,
+		}
+		if err := e.unpackMsg(payload); err != nil {
+			s.emitErr(err)
+		} else {
+			// 缓冲区会被复用，需拷贝
+			if s.keepRaw {
+				e.Raw = append([]byte(nil), payload...)
+			}
+			s.emit(e)
+		}
+		s.buf = rest
+	}
+
+	// 消息已全部消费时释放底层数组，避免长连接持续占用内存
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+}
+
+func splitTcpMessage(b []byte) (payload, rest []byte, ok bool) {
+	if len(b) < tcpMessageLengthPrefix {
+		return nil, b, false
+	}
+
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < tcpMessageLengthPrefix+l {
+		return nil, b, false
+	}
+
+	return b[tcpMessageLengthPrefix : tcpMessageLengthPrefix+l], b[tcpMessageLengthPrefix+l:], true
+}
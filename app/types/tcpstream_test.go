@@ -0,0 +1,96 @@
+package types
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/miekg/dns"
+)
+
+func TestDnsStreamSplit(t *testing.T) {
+	var stream []byte
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = binary.BigEndian.AppendUint16(stream, uint16(len(b)))
+		stream = append(stream, b...)
+	}
+
+	var events []*DnsEvent
+	s := &dnsStream{
+		srcIP:   "10.0.0.1",
+		dstIP:   "10.0.0.2",
+		srcPort: 40000,
+		dstPort: 53,
+		emit: func(e *DnsEvent) {
+			events = append(events, e)
+		},
+		emitErr: func(err error) {
+			t.Fatal(err)
+		},
+	}
+
+	// 长度前缀与消息体被拆分在不同分段中
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: stream[:1], Seen: time.Now()}})
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: stream[1:20], Seen: time.Now()}})
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: stream[20:], Seen: time.Now()}})
+
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got %d", len(events))
+	}
+	if events[0].Domain != "a.example.com." || events[1].Domain != "b.example.com." {
+		t.Fatalf("unexpected domains %s %s", events[0].Domain, events[1].Domain)
+	}
+	if events[0].Transport != TransportTCP || events[0].DestinationPort != 53 {
+		t.Fatalf("unexpected transport %s port %d", events[0].Transport, events[0].DestinationPort)
+	}
+	if len(s.buf) != 0 {
+		t.Fatalf("expect empty buffer, got %d bytes", len(s.buf))
+	}
+}
+
+func TestDnsStreamMidStream(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.com.", dns.TypeA)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(b)))
+	msg = append(msg, b...)
+
+	var events []*DnsEvent
+	var errs []error
+	s := &dnsStream{
+		srcIP:   "10.0.0.1",
+		dstIP:   "10.0.0.2",
+		srcPort: 40000,
+		dstPort: 53,
+		emit: func(e *DnsEvent) {
+			events = append(events, e)
+		},
+		emitErr: func(err error) {
+			errs = append(errs, err)
+		},
+	}
+
+	// 抓包开始时连接已建立，首个分段从消息中间开始，后续分段即使完整也无法确定边界
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: msg[5:], Skip: -1, Seen: time.Now()}})
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: msg, Seen: time.Now()}})
+
+	if len(events) != 0 {
+		t.Fatalf("expect no events, got %d", len(events))
+	}
+	if len(errs) != 1 || errReason(errs[0]) != ErrReasonTcpStream {
+		t.Fatalf("expect one tcp stream error, got %v", errs)
+	}
+	if len(s.buf) != 0 {
+		t.Fatalf("expect empty buffer, got %d bytes", len(s.buf))
+	}
+}
@@ -0,0 +1,214 @@
+package types
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hiwyw/dnscap-tool/app/logger"
+)
+
+type WatchAction string
+
+const (
+	WatchActionKeep   WatchAction = "keep"
+	WatchActionMove   WatchAction = "move"
+	WatchActionDelete WatchAction = "delete"
+)
+
+const (
+	defaultWatchPollInterval = time.Second * 10
+	defaultWatchSettleTime   = time.Second * 30
+)
+
+type WatchOptions struct {
+	Dir          string
+	Pattern      string
+	PollInterval time.Duration
+	SettleTime   time.Duration
+	LedgerFile   string
+	Action       WatchAction
+	MoveDir      string
+}
+
+func NewWatchSource(ctx context.Context, workerCount int, bpf string, decodeOpts DecodeOptions, opts WatchOptions, finalizer func()) *PcapEventSource {
+	s := newPcapEventSource(ctx, workerCount, PcapModeWatch, []string{}, nil, bpf, decodeOpts, CaptureOptions{}, finalizer)
+	s.watchOpts = opts
+	go s.run()
+	return s
+}
+
+// handleWatch 轮询目录，修改时间超过settle_time的文件视为抓包程序已关闭，按文件名顺序逐个处理，任一路径退出均关闭事件源
+func (s *PcapEventSource) handleWatch() {
+	defer s.close()
+
+	opts := s.watchOpts
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultWatchPollInterval
+	}
+	if opts.SettleTime <= 0 {
+		opts.SettleTime = defaultWatchSettleTime
+	}
+
+	ledger, err := openWatchLedger(opts.LedgerFile)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+	defer ledger.close()
+
+	if opts.Action == WatchActionMove {
+		if err := os.MkdirAll(opts.MoveDir, 0755); err != nil {
+			logger.Fatalf("create watch move dir %s failed %s", opts.MoveDir, err)
+			return
+		}
+	}
+
+	logger.Infof("begin watch dir %s pattern %s, %d files already handled", opts.Dir, opts.Pattern, len(ledger.done))
+
+	// failed 读取失败的文件，本次运行内不再重试
+	failed := map[string]struct{}{}
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		files, err := settledFiles(opts.Dir, opts.Pattern, opts.SettleTime)
+		if err != nil {
+			logger.Errorf("scan watch dir %s failed %s", opts.Dir, err)
+		}
+
+		for _, f := range files {
+			if ledger.has(f) {
+				continue
+			}
+			if _, ok := failed[f]; ok {
+				continue
+			}
+			err := s.handleWatchFile(f, ledger, opts)
+			if s.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				failed[f] = struct{}{}
+				logger.Errorf("handle pcap file %s failed %s, keep it in place and retry after restart", f, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			logger.Infof("watch dir groutinue exiting by receive signal")
+			return
+		}
+	}
+}
+
+// handleWatchFile 完整读取后记入台账并执行处理后动作；读取失败或处理中途退出时均不记入台账也不移动删除，重启后重新处理
+func (s *PcapEventSource) handleWatchFile(f string, ledger *watchLedger, opts WatchOptions) error {
+	logger.Infof("begin handle pcap file %s", f)
+	if err := s.handleFile(f); err != nil {
+		return err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	logger.Infof("end handle pcap file %s", f)
+
+	if err := ledger.add(f); err != nil {
+		logger.Errorf("write watch ledger %s failed %s", opts.LedgerFile, err)
+	}
+	if err := finishWatchFile(f, opts); err != nil {
+		logger.Errorf("%s pcap file %s failed %s", opts.Action, f, err)
+	}
+	return nil
+}
+
+func settledFiles(dir, pattern string, settle time.Duration) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if time.Since(info.ModTime()) < settle {
+			continue
+		}
+		files = append(files, m)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func finishWatchFile(f string, opts WatchOptions) error {
+	switch opts.Action {
+	case WatchActionMove:
+		return os.Rename(f, filepath.Join(opts.MoveDir, filepath.Base(f)))
+	case WatchActionDelete:
+		return os.Remove(f)
+	default:
+		return nil
+	}
+}
+
+// watchLedger 已处理文件台账，每行一个文件路径，追加写入
+type watchLedger struct {
+	file *os.File
+	done map[string]struct{}
+}
+
+func openWatchLedger(fp string) (*watchLedger, error) {
+	l := &watchLedger{
+		done: map[string]struct{}{},
+	}
+	if fp == "" {
+		return l, nil
+	}
+
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open watch ledger %s failed %s", fp, err)
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			l.done[line] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read watch ledger %s failed %s", fp, err)
+	}
+	l.file = f
+	return l, nil
+}
+
+func (l *watchLedger) has(f string) bool {
+	_, ok := l.done[f]
+	return ok
+}
+
+func (l *watchLedger) add(f string) error {
+	l.done[f] = struct{}{}
+	if l.file == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintln(l.file, f); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *watchLedger) close() {
+	if l.file != nil {
+		l.file.Close()
+	}
+}
@@ -0,0 +1,151 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestWatchLedger(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "a.pcap")
+	fresh := filepath.Join(dir, "b.pcap")
+	for _, f := range []string{old, fresh, filepath.Join(dir, "c.txt")} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// 仍在写入的文件不处理
+	files, err := settledFiles(dir, "*.pcap", time.Second*30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != old {
+		t.Fatalf("unexpected settled files %v", files)
+	}
+
+	ledgerFile := filepath.Join(dir, "watch.ledger")
+	l, err := openWatchLedger(ledgerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add(old); err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+
+	// 重新打开后台账保留
+	l, err = openWatchLedger(ledgerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if !l.has(old) || l.has(fresh) {
+		t.Fatalf("unexpected ledger %v", l.done)
+	}
+}
+
+func TestWatchFileReadError(t *testing.T) {
+	dir := t.TempDir()
+	writeGzipPcap := func(name string, truncate bool) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		pw := pcapgo.NewWriter(zw)
+		if err := pw.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 1000)
+		for i := 0; i < 100; i++ {
+			rand.Read(data)
+			if err := pw.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		zw.Close()
+		b := buf.Bytes()
+		if truncate {
+			b = b[:len(b)/2]
+		}
+		fp := filepath.Join(dir, name)
+		if err := os.WriteFile(fp, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	corrupt := writeGzipPcap("a.pcap.gz", true)
+	complete := writeGzipPcap("b.pcap.gz", false)
+
+	s := newPcapEventSource(context.Background(), 1, PcapModeWatch, nil, nil, "", DecodeOptions{DnsPorts: []uint16{53}}, CaptureOptions{}, func() {})
+	go func() {
+		for range s.errEventCh {
+		}
+	}()
+	ledger, err := openWatchLedger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := WatchOptions{Action: WatchActionDelete}
+
+	// 截断的文件返回错误，不记入台账也不删除
+	if err := s.handleWatchFile(corrupt, ledger, opts); err == nil {
+		t.Fatal("expect read error of truncated file")
+	}
+	if ledger.has(corrupt) {
+		t.Fatal("truncated file should not be recorded")
+	}
+	if _, err := os.Stat(corrupt); err != nil {
+		t.Fatalf("truncated file should be kept %s", err)
+	}
+
+	if err := s.handleWatchFile(complete, ledger, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !ledger.has(complete) {
+		t.Fatal("complete file should be recorded")
+	}
+	if _, err := os.Stat(complete); !os.IsNotExist(err) {
+		t.Fatalf("complete file should be deleted %v", err)
+	}
+}
+
+func TestWatchExitOnReadErrorAfterCancel(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "a.pcap")
+	if err := os.WriteFile(f, []byte("not a pcap file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(f, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// 读取文件失败时已收到退出信号，事件源仍需关闭
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	closed := make(chan struct{})
+	s := NewWatchSource(ctx, 1, "", DecodeOptions{DnsPorts: []uint16{53}}, WatchOptions{Dir: dir, Pattern: "*.pcap", Action: WatchActionKeep}, func() {
+		close(closed)
+	})
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("watch source not closed")
+	}
+	if _, ok := <-s.Events(); ok {
+		t.Fatal("events channel should be closed")
+	}
+}
@@ -0,0 +1,97 @@
+package types
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// decodeQueueSize 每个解码worker的任务队列长度
+const decodeQueueSize = 128
+
+// newDecodeWorkers 按哈希将解码任务分发至workerCount个固定worker，同一哈希的任务按提交顺序执行，
+// 同一会话流的请求与响应保持到达顺序，不同流之间并行
+func newDecodeWorkers(workerCount int) *decodeWorkers {
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	w := &decodeWorkers{
+		chs:  make([]chan func(), workerCount),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for i := range w.chs {
+		ch := make(chan func(), decodeQueueSize)
+		w.chs[i] = ch
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for task := range ch {
+				task()
+			}
+		}()
+	}
+	go func() {
+		w.wg.Wait()
+		close(w.done)
+	}()
+	return w
+}
+
+type decodeWorkers struct {
+	chs  []chan func()
+	wg   sync.WaitGroup
+	done chan struct{}
+	// stop 释放时关闭，唤醒阻塞在队列上的提交；submitting为进行中的提交，全部返回后才关闭队列
+	stop       chan struct{}
+	submitting sync.WaitGroup
+	mu         sync.Mutex
+	closed     bool
+}
+
+// submit 释放后提交或因释放而放弃等待队列的任务不再执行，返回false
+func (w *decodeWorkers) submit(hash uint32, task func()) bool {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return false
+	}
+	w.submitting.Add(1)
+	w.mu.Unlock()
+	defer w.submitting.Done()
+
+	select {
+	case w.chs[hash%uint32(len(w.chs))] <- task:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+// release 不再接收新任务并等待已提交的任务执行完成，超时后返回错误，未完成的任务继续执行，可由wait等待其结束
+func (w *decodeWorkers) release(timeout time.Duration) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.stop)
+		w.mu.Unlock()
+		w.submitting.Wait()
+		for _, ch := range w.chs {
+			close(ch)
+		}
+	} else {
+		w.mu.Unlock()
+	}
+
+	select {
+	case <-w.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("decode workers release timeout after %s", timeout)
+	}
+}
+
+// wait 等待全部worker退出
+func (w *decodeWorkers) wait() {
+	<-w.done
+}
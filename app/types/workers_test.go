@@ -0,0 +1,57 @@
+package types
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDecodeWorkersReleaseWithBlockedSubmit(t *testing.T) {
+	w := newDecodeWorkers(1)
+
+	block := make(chan struct{})
+	var executed atomic.Int32
+	w.submit(0, func() {
+		<-block
+	})
+	for i := 0; i < decodeQueueSize; i++ {
+		w.submit(0, func() {
+			executed.Add(1)
+		})
+	}
+
+	// 队列已满，提交阻塞
+	submitted := make(chan bool)
+	go func() {
+		submitted <- w.submit(0, func() {
+			executed.Add(1)
+		})
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	// 释放不能因阻塞中的提交而死锁
+	released := make(chan error)
+	go func() {
+		released <- w.release(time.Millisecond * 100)
+	}()
+	select {
+	case ok := <-submitted:
+		if ok {
+			t.Fatal("blocked submit should be abandoned on release")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("blocked submit not woken by release")
+	}
+	if err := <-released; err == nil {
+		t.Fatal("expect release timeout while task blocked")
+	}
+
+	close(block)
+	w.wait()
+	if executed.Load() != decodeQueueSize {
+		t.Fatalf("expect %d queued tasks executed, got %d", decodeQueueSize, executed.Load())
+	}
+	if w.submit(0, func() {}) {
+		t.Fatal("submit after release should be rejected")
+	}
+}
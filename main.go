@@ -13,12 +13,14 @@ import (
 	"github.com/hiwyw/dnscap-tool/app/config"
 	"github.com/hiwyw/dnscap-tool/app/logger"
 	"github.com/hiwyw/dnscap-tool/app/pkg/signal"
+	"github.com/hiwyw/dnscap-tool/app/types"
 )
 
 var (
 	genConfig    bool
 	printVersion bool
 	showDevices  bool
+	printSchema  string
 
 	configFile string
 	build      = ""
@@ -30,6 +32,7 @@ func main() {
 	flag.BoolVar(&genConfig, "gen", false, "gen demo config file")
 	flag.BoolVar(&printVersion, "version", false, "print version")
 	flag.BoolVar(&showDevices, "devices", false, "print all devices")
+	flag.StringVar(&printSchema, "schema", "", "print event schema, ddl|proto|csv")
 	flag.Parse()
 
 	if printVersion {
@@ -37,6 +40,20 @@ func main() {
 		return
 	}
 
+	if printSchema != "" {
+		switch printSchema {
+		case "ddl":
+			fmt.Print(types.DnsEventDDL("dnsevent"))
+		case "proto":
+			fmt.Print(types.ProtoSchema())
+		case "csv":
+			fmt.Println(strings.Join(types.CsvHeader(), ","))
+		default:
+			log.Fatalf("unknown schema format %s", printSchema)
+		}
+		return
+	}
+
 	if genConfig {
 		config.Generate(configFile)
 		log.Printf("gen demo config %s succeed", configFile)
@@ -0,0 +1,246 @@
+-- schema version 8
+CREATE TABLE IF NOT EXISTS dnsevent (
+    SchemaVersion UINTEGER,
+    EventTime DATETIME,
+    SourceIP VARCHAR,
+    SourcePort USMALLINT,
+    DestinationIP VARCHAR,
+    DestinationPort USMALLINT,
+    TranscationID USMALLINT,
+    View VARCHAR,
+    Domain VARCHAR,
+    QueryClass VARCHAR,
+    QueryType VARCHAR,
+    Rcode VARCHAR,
+    Response BOOLEAN,
+    Authoritative BOOLEAN,
+    Truncated BOOLEAN,
+    RecursionDesired BOOLEAN,
+    RecursionAvailable BOOLEAN,
+    Zero BOOLEAN,
+    AuthenticatedData BOOLEAN,
+    CheckingDisabled BOOLEAN,
+    DelayMicrosecond BIGINT,
+    Answer STRUCT(
+        Domain VARCHAR,
+        TTL UINTEGER,
+        Rclass VARCHAR,
+        Rtype VARCHAR,
+        Rdata VARCHAR,
+        RdataFields STRUCT(
+            Address VARCHAR,
+            Target VARCHAR,
+            Priority USMALLINT,
+            Weight USMALLINT,
+            Port USMALLINT,
+            Mname VARCHAR,
+            Rname VARCHAR,
+            Serial UINTEGER,
+            Refresh UINTEGER,
+            Retry UINTEGER,
+            Expire UINTEGER,
+            Minimum UINTEGER,
+            Txt VARCHAR[],
+            Flags USMALLINT,
+            Protocol UTINYINT,
+            Algorithm UTINYINT,
+            PublicKey VARCHAR,
+            KeyTag USMALLINT,
+            DigestType UTINYINT,
+            Digest VARCHAR,
+            TypeCovered VARCHAR,
+            Labels UTINYINT,
+            OrigTtl UINTEGER,
+            Expiration UINTEGER,
+            Inception UINTEGER,
+            SignerName VARCHAR,
+            Signature VARCHAR,
+            SvcParams MAP(VARCHAR, VARCHAR)
+        )
+    )[],
+    Authority STRUCT(
+        Domain VARCHAR,
+        TTL UINTEGER,
+        Rclass VARCHAR,
+        Rtype VARCHAR,
+        Rdata VARCHAR,
+        RdataFields STRUCT(
+            Address VARCHAR,
+            Target VARCHAR,
+            Priority USMALLINT,
+            Weight USMALLINT,
+            Port USMALLINT,
+            Mname VARCHAR,
+            Rname VARCHAR,
+            Serial UINTEGER,
+            Refresh UINTEGER,
+            Retry UINTEGER,
+            Expire UINTEGER,
+            Minimum UINTEGER,
+            Txt VARCHAR[],
+            Flags USMALLINT,
+            Protocol UTINYINT,
+            Algorithm UTINYINT,
+            PublicKey VARCHAR,
+            KeyTag USMALLINT,
+            DigestType UTINYINT,
+            Digest VARCHAR,
+            TypeCovered VARCHAR,
+            Labels UTINYINT,
+            OrigTtl UINTEGER,
+            Expiration UINTEGER,
+            Inception UINTEGER,
+            SignerName VARCHAR,
+            Signature VARCHAR,
+            SvcParams MAP(VARCHAR, VARCHAR)
+        )
+    )[],
+    Additional STRUCT(
+        Domain VARCHAR,
+        TTL UINTEGER,
+        Rclass VARCHAR,
+        Rtype VARCHAR,
+        Rdata VARCHAR,
+        RdataFields STRUCT(
+            Address VARCHAR,
+            Target VARCHAR,
+            Priority USMALLINT,
+            Weight USMALLINT,
+            Port USMALLINT,
+            Mname VARCHAR,
+            Rname VARCHAR,
+            Serial UINTEGER,
+            Refresh UINTEGER,
+            Retry UINTEGER,
+            Expire UINTEGER,
+            Minimum UINTEGER,
+            Txt VARCHAR[],
+            Flags USMALLINT,
+            Protocol UTINYINT,
+            Algorithm UTINYINT,
+            PublicKey VARCHAR,
+            KeyTag USMALLINT,
+            DigestType UTINYINT,
+            Digest VARCHAR,
+            TypeCovered VARCHAR,
+            Labels UTINYINT,
+            OrigTtl UINTEGER,
+            Expiration UINTEGER,
+            Inception UINTEGER,
+            SignerName VARCHAR,
+            Signature VARCHAR,
+            SvcParams MAP(VARCHAR, VARCHAR)
+        )
+    )[],
+    Edns VARCHAR,
+    EdnsClientSubnet VARCHAR,
+    EdnsClientSubnetInfo STRUCT(
+        IP VARCHAR,
+        Country VARCHAR,
+        Province VARCHAR,
+        City VARCHAR,
+        County VARCHAR,
+        Isp VARCHAR,
+        DC VARCHAR,
+        App VARCHAR,
+        Custom VARCHAR
+    ),
+    SourceIpInfo STRUCT(
+        IP VARCHAR,
+        Country VARCHAR,
+        Province VARCHAR,
+        City VARCHAR,
+        County VARCHAR,
+        Isp VARCHAR,
+        DC VARCHAR,
+        App VARCHAR,
+        Custom VARCHAR
+    ),
+    AnswerIP VARCHAR,
+    AnswerIpInfo STRUCT(
+        IP VARCHAR,
+        Country VARCHAR,
+        Province VARCHAR,
+        City VARCHAR,
+        County VARCHAR,
+        Isp VARCHAR,
+        DC VARCHAR,
+        App VARCHAR,
+        Custom VARCHAR
+    ),
+    AnswerIPs VARCHAR[],
+    AnswerIpInfos STRUCT(
+        IP VARCHAR,
+        Country VARCHAR,
+        Province VARCHAR,
+        City VARCHAR,
+        County VARCHAR,
+        Isp VARCHAR,
+        DC VARCHAR,
+        App VARCHAR,
+        Custom VARCHAR
+    )[],
+    CnameChain VARCHAR[],
+    FinalTarget VARCHAR,
+    SecondLevelDomain VARCHAR,
+    ByteLength UINTEGER,
+    QueryByteLength UINTEGER,
+    SubdomainByteLength UINTEGER,
+    LabelCount UINTEGER,
+    SubdomainLabelCount UINTEGER,
+    SubdomainEntropy DOUBLE,
+    SubdomainLabelEncoded BOOLEAN,
+    TrafficDirection VARCHAR,
+    Transport VARCHAR,
+    VlanID USMALLINT,
+    Vni UINTEGER,
+    UnexpectedPort BOOLEAN,
+    Interface VARCHAR,
+    Raw BLOB,
+    EdnsUdpSize USMALLINT,
+    EdnsDo BOOLEAN,
+    EdnsVersion UTINYINT,
+    EdnsExtendedRcode USMALLINT,
+    EdnsCookieClient VARCHAR,
+    EdnsCookieServer VARCHAR,
+    EdnsNsid VARCHAR,
+    EdnsPaddingLength USMALLINT,
+    EdnsKeepalive USMALLINT,
+    EdnsEde STRUCT(
+        InfoCode USMALLINT,
+        Name VARCHAR,
+        ExtraText VARCHAR
+    )[],
+    Opcode VARCHAR,
+    QuestionCount USMALLINT,
+    AnswerCount USMALLINT,
+    AuthorityCount USMALLINT,
+    AdditionalCount USMALLINT,
+    Questions STRUCT(
+        Domain VARCHAR,
+        QueryClass VARCHAR,
+        QueryType VARCHAR
+    )[],
+    CountMismatch BOOLEAN,
+    NormalizedDomain VARCHAR,
+    UnicodeDomain VARCHAR,
+    IdnaError VARCHAR,
+    TimedOut BOOLEAN,
+    TransactionStatus VARCHAR,
+    QueryTime DATETIME,
+    ResponseTime DATETIME,
+    QueryRecursionDesired BOOLEAN,
+    QueryCheckingDisabled BOOLEAN,
+    QueryAuthenticatedData BOOLEAN,
+    QueryEdnsDo BOOLEAN,
+    Attempt UINTEGER,
+    Retransmission BOOLEAN,
+    FirstAnswerDelayMicrosecond BIGINT,
+    DuplicateResponse BOOLEAN,
+    ResolutionId VARCHAR,
+    ResolutionMicrosecond BIGINT,
+    UpstreamMicrosecond BIGINT,
+    UpstreamQueryCount UINTEGER,
+    CacheStatus VARCHAR,
+    SharedRecursion BOOLEAN
+);
@@ -2,6 +2,7 @@
 # coding=utf-8
 import duckdb
 import logging
+import os
 # import glob
 
 LOG_FORMAT = "%(asctime)s - %(levelname)s - %(message)s"
@@ -9,94 +10,9 @@ logging.basicConfig(level=logging.INFO, filename="run.log", format=LOG_FORMAT)
 
 DB_FILE_NAME = "dnslog.db"
 
-create_sql = """CREATE TABLE IF NOT EXISTS dnsevent (
-    EventTime DATETIME,
-    SourceIP VARCHAR,
-    SourcePort USMALLINT,
-    DestinationIP VARCHAR,
-    DestinationPort USMALLINT,
-    TranscationID USMALLINT,
-    View VARCHAR,
-    Domain VARCHAR,
-    QueryClass VARCHAR,
-    QueryType VARCHAR,
-    Rcode VARCHAR,
-    Response BOOLEAN,
-    Authoritative BOOLEAN,
-    Truncated BOOLEAN,
-    RecursionDesired BOOLEAN,
-    RecursionAvailable BOOLEAN,
-    Zero BOOLEAN,
-    AuthenticatedData BOOLEAN,
-    CheckingDisabled BOOLEAN,
-    DelayMicrosecond BIGINT,
-    Answer STRUCT(
-        Domain VARCHAR,
-        TTL UINTEGER,
-        Rclass VARCHAR,
-        Rtype VARCHAR,
-        Rdata VARCHAR
-        )[],
-    Authority STRUCT(
-        Domain VARCHAR,
-        TTL UINTEGER,
-        Rclass VARCHAR,
-        Rtype VARCHAR,
-        Rdata VARCHAR
-        )[],
-    Additional STRUCT(
-        Domain VARCHAR,
-        TTL UINTEGER,
-        Rclass VARCHAR,
-        Rtype VARCHAR,
-        Rdata VARCHAR
-        )[],
-    Edns VARCHAR,
-    EdnsClientSubnet VARCHAR,
-    EdnsClientSubnetInfo STRUCT(
-        IP VARCHAR,
-        Country VARCHAR,
-        Province VARCHAR,
-        City VARCHAR,
-        County VARCHAR,
-        Isp VARCHAR,
-        DC VARCHAR,
-        App VARCHAR,
-        Custom VARCHAR
-    ),
-    SourceIpInfo STRUCT(
-        IP VARCHAR,
-        Country VARCHAR,
-        Province VARCHAR,
-        City VARCHAR,
-        County VARCHAR,
-        Isp VARCHAR,
-        DC VARCHAR,
-        App VARCHAR,
-        Custom VARCHAR
-    ),
-    AnswerIP VARCHAR,
-    AnswerIpInfo STRUCT(
-        IP VARCHAR,
-        Country VARCHAR,
-        Province VARCHAR,
-        City VARCHAR,
-        County VARCHAR,
-        Isp VARCHAR,
-        DC VARCHAR,
-        App VARCHAR,
-        Custom VARCHAR
-    ),
-    SecondLevelDomain VARCHAR,
-    ByteLength UINTEGER,
-    QueryByteLength UINTEGER,
-    SubdomainByteLength UINTEGER,
-    LabelCount UINTEGER,
-    SubdomainLabelCount UINTEGER,
-    SubdomainEntropy DOUBLE,
-    SubdomainLabelEncoded BOOLEAN,
-    TrafficDirection VARCHAR
-)"""
+# 建表语句由 dnscap-tool -schema ddl 生成，与程序写入的duckdb表结构一致
+with open(os.path.join(os.path.dirname(os.path.abspath(__file__)), "dnsevent.sql")) as f:
+    create_sql = f.read()
 
 
 def initDB(conn: duckdb.DuckDBPyConnection):
@@ -110,7 +26,11 @@ def copyJsonlogFile(conn: duckdb.DuckDBPyConnection, jsonlog_filename: str):
         logging.error("jsonlog filename is empty, ignore it")
         return
     logging.info("begin copy {} to database".format(jsonlog_filename))
-    conn.sql("COPY dnsevent FROM '{}'".format(jsonlog_filename))
+    # Raw在jsonlog中为base64编码，先导入临时表再解码写入
+    conn.sql("CREATE OR REPLACE TEMP TABLE dnsevent_staging AS SELECT * FROM dnsevent LIMIT 0")
+    conn.sql("COPY dnsevent_staging FROM '{}'".format(jsonlog_filename))
+    conn.sql("INSERT INTO dnsevent SELECT * REPLACE (from_base64(decode(Raw)) AS Raw) FROM dnsevent_staging")
+    conn.sql("DROP TABLE dnsevent_staging")
     logging.info("end copy {} to database".format(jsonlog_filename))
 
 